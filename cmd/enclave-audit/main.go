@@ -0,0 +1,55 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+// enclave-audit verifies the hash chain of the enclave-sim audit log.
+//
+// Exit status is 0 when every record verifies, 1 when records have been
+// altered or deleted and 2 on any other error.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/donaldww/idemo2/internal/audit"
+	"github.com/donaldww/idemo2/internal/config"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("enclave-audit: ")
+	cf := config.NewConfig("config")
+	file := flag.String("f", cf.Settings().AuditLog, "audit log to verify")
+	expect := flag.Int64("n", 0, "expected number of records, to detect truncation")
+	asJSON := flag.Bool("json", false, "write JSON output")
+	flag.Parse()
+
+	n, err := audit.Verify(*file)
+	var chainErr audit.ChainError
+	if err != nil && !errors.As(err, &chainErr) {
+		log.Print(err)
+		os.Exit(2)
+	}
+	if err == nil && *expect > n {
+		err = fmt.Errorf("audit: %d records found, %d expected: records missing", n, *expect)
+	}
+	if *asJSON {
+		out := map[string]interface{}{"file": *file, "records": n, "verified": err == nil}
+		if err != nil {
+			out["error"] = err.Error()
+		}
+		_ = json.NewEncoder(os.Stdout).Encode(out)
+	} else if err == nil {
+		fmt.Printf("%s: %d records verified.\n", *file, n)
+	} else {
+		fmt.Printf("%s: %d records verified, then: %v\n", *file, n, err)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
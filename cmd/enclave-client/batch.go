@@ -0,0 +1,211 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Exit status of exec and run.
+const (
+	exitOK      = 0 // the command succeeded, or every assertion held
+	exitFailed  = 1 // the command was refused, or an assertion failed
+	exitTrouble = 2 // bad usage, a bad script or a lost connection
+)
+
+// step is a command of a script and the assertions on its reply.
+type step struct {
+	lineNo  int
+	line    string
+	expects []expect
+}
+
+// expect is an assertion on a reply: it holds if the reply, without the
+// "enclave-sim: " prefix, contains text or matches re.
+type expect struct {
+	lineNo int
+	text   string
+	re     *regexp.Regexp
+}
+
+func (e expect) holds(reply string) bool {
+	if e.re != nil {
+		return e.re.MatchString(strip(reply))
+	}
+	return strings.Contains(strip(reply), e.text)
+}
+
+func (e expect) String() string {
+	if e.re != nil {
+		return "/" + e.re.String() + "/"
+	}
+	return e.text
+}
+
+// result is the JSON output for a command.
+type result struct {
+	Line    int       `json:"line,omitempty"`
+	Command string    `json:"command,omitempty"`
+	Reply   string    `json:"reply,omitempty"`
+	Refused bool      `json:"refused"`
+	Expects []outcome `json:"expects,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// outcome is the JSON output for an assertion.
+type outcome struct {
+	Line   int    `json:"line"`
+	Expect string `json:"expect"`
+	OK     bool   `json:"ok"`
+}
+
+// summary is the JSON output at the end of a script.
+type summary struct {
+	Script   string `json:"script"`
+	Commands int    `json:"commands"`
+	Expects  int    `json:"expects"`
+	Failed   int    `json:"failed"`
+	Passed   bool   `json:"passed"`
+}
+
+// execOne sends a single command and prints the reply. The exit status is
+// exitFailed if enclave-sim refuses it.
+func execOne(c *client, line string, asJSON bool) int {
+	out := json.NewEncoder(os.Stdout)
+	cmd, args, err := parse(line)
+	if err == nil && cmd.local {
+		err = fmt.Errorf("%s is only available in the shell", cmd.name)
+	}
+	if err != nil {
+		return trouble(out, asJSON, result{Command: line}, err)
+	}
+	reply, err := c.send(cmd.line(args))
+	if err != nil {
+		return trouble(out, asJSON, result{Command: cmd.line(args)}, err)
+	}
+	if asJSON {
+		_ = out.Encode(result{Command: cmd.line(args), Reply: strip(reply), Refused: refused(reply)})
+	} else {
+		fmt.Println(reply)
+	}
+	if refused(reply) {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// runScript runs the commands of a script and checks the assertions on
+// their replies. The exit status is exitFailed if any assertion fails.
+func runScript(c *client, path string, asJSON bool) int {
+	out := json.NewEncoder(os.Stdout)
+	steps, err := readScript(path)
+	if err != nil {
+		return trouble(out, asJSON, result{}, err)
+	}
+	sum := summary{Script: path}
+	for _, s := range steps {
+		reply, err := c.send(s.line)
+		if err != nil {
+			return trouble(out, asJSON, result{Line: s.lineNo, Command: s.line}, err)
+		}
+		r := result{Line: s.lineNo, Command: s.line, Reply: strip(reply), Refused: refused(reply)}
+		if !asJSON {
+			fmt.Printf("> %s\n%s\n", s.line, reply)
+		}
+		for _, e := range s.expects {
+			ok := e.holds(reply)
+			r.Expects = append(r.Expects, outcome{Line: e.lineNo, Expect: e.String(), OK: ok})
+			sum.Expects++
+			if !ok {
+				sum.Failed++
+				if !asJSON {
+					fmt.Printf("%s:%d: expected %s\n", path, e.lineNo, e)
+				}
+			}
+		}
+		sum.Commands++
+		if asJSON {
+			_ = out.Encode(r)
+		}
+	}
+	sum.Passed = sum.Failed == 0
+	if asJSON {
+		_ = out.Encode(sum)
+	} else {
+		fmt.Printf("%s: %d commands, %d of %d expectations met.\n", path, sum.Commands,
+			sum.Expects-sum.Failed, sum.Expects)
+	}
+	if !sum.Passed {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// readScript parses a script. Each line holds a command, an assertion on
+// the reply to the command before it or a comment:
+//
+//	# the balance grows by what is bought
+//	buy 10
+//	expect bought: 10.00 IC.
+//	bal
+//	expect /balance: [0-9.]+ IC/
+func readScript(path string) ([]step, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var steps []step
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if text, ok := strings.CutPrefix(line, "expect "); ok {
+			if len(steps) == 0 {
+				return nil, fmt.Errorf("%s:%d: expect before the first command", path, n)
+			}
+			e := expect{lineNo: n, text: strings.TrimSpace(text)}
+			if len(e.text) > 1 && strings.HasPrefix(e.text, "/") && strings.HasSuffix(e.text, "/") {
+				if e.re, err = regexp.Compile(e.text[1 : len(e.text)-1]); err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+				}
+			}
+			last := &steps[len(steps)-1]
+			last.expects = append(last.expects, e)
+			continue
+		}
+		cmd, args, err := parse(line)
+		if err == nil && cmd.local {
+			err = fmt.Errorf("%s is only available in the shell", cmd.name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		steps = append(steps, step{lineNo: n, line: cmd.line(args)})
+	}
+	return steps, s.Err()
+}
+
+// trouble reports an error that stops exec or run.
+func trouble(out *json.Encoder, asJSON bool, r result, err error) int {
+	if err == io.EOF {
+		err = fmt.Errorf("enclave-sim closed the connection")
+	}
+	if asJSON {
+		r.Error = err.Error()
+		_ = out.Encode(r)
+	} else {
+		fmt.Fprintf(os.Stderr, "enclave-client: %v\n", err)
+	}
+	return exitTrouble
+}
@@ -0,0 +1,216 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverPrefix starts every enclave-sim reply. In a reply of several
+// lines, morePrefix starts every line but the last. refusedPrefix follows
+// serverPrefix in a reply that refuses the command.
+const (
+	serverPrefix  = "enclave-sim: "
+	morePrefix    = "enclave-sim- "
+	refusedPrefix = "refused: "
+)
+
+// The delay before reconnecting doubles after every failed attempt, from
+// minBackoff up to maxBackoff.
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// errGaveUp is returned once reconnecting has failed too many times.
+var errGaveUp = errors.New("enclave-sim is unreachable")
+
+// client is a connection to enclave-sim. After the connection is lost it
+// is opened again by the next request, when reconnect is set. It is safe
+// for concurrent use.
+type client struct {
+	addr       string
+	timeout    time.Duration // for a reply; 0 waits forever
+	reconnect  bool
+	reconnects int              // attempts before giving up; 0 tries forever
+	status     func(msg string) // reports losing and regaining the connection
+
+	mu     sync.Mutex
+	conn   net.Conn
+	r      *bufio.Reader
+	gaveUp bool // the last reconnect failed
+}
+
+// dial connects to enclave-sim.
+func dial(addr string, timeout time.Duration) (*client, error) {
+	c := &client{addr: addr, timeout: timeout, status: func(string) {}}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *client) open() error {
+	conn, err := net.DialTimeout("tcp", c.addr, c.dialTimeout())
+	if err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	return nil
+}
+
+func (c *client) dialTimeout() time.Duration {
+	if c.timeout > 0 {
+		return c.timeout
+	}
+	return maxBackoff
+}
+
+// send sends a command and returns the reply, without the last newline.
+// The lines of a longer reply are joined, with the prefix only at the
+// start. If no reply arrives in time, or the connection breaks, the
+// connection is closed: the command may or may not have been executed.
+func (c *client) send(line string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.roundTrip(line)
+}
+
+// heartbeat pings enclave-sim at the given interval, so a lost connection
+// is noticed, and reopened, while the user is idle.
+func (c *client) heartbeat(every time.Duration) {
+	for range time.Tick(every) {
+		_ = c.ping()
+	}
+}
+
+// ping sends a heartbeat, unless a command is on its way. It reconnects
+// if the connection has been lost, unless reconnecting has failed.
+func (c *client) ping() error {
+	if !c.mu.TryLock() {
+		return nil
+	}
+	defer c.mu.Unlock()
+	if c.conn == nil && c.gaveUp {
+		return errGaveUp
+	}
+	reply, err := c.roundTrip("ping")
+	if err == errGaveUp {
+		c.status("giving up; the next command tries again.")
+	}
+	if err == nil && strip(reply) != "pong" {
+		err = fmt.Errorf("unexpected reply to ping: %q", reply)
+		c.drop(err)
+	}
+	return err
+}
+
+// roundTrip sends a line and reads the reply. c.mu must be held.
+func (c *client) roundTrip(line string) (string, error) {
+	if c.conn == nil {
+		if !c.reconnect {
+			return "", errGaveUp
+		}
+		if err := c.redial(); err != nil {
+			return "", err
+		}
+	}
+	if c.timeout > 0 {
+		_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.drop(err)
+		return "", err
+	}
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = fmt.Errorf("no reply within %v", c.timeout)
+		}
+		if err != nil {
+			c.drop(err)
+			return "", err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if !strings.HasPrefix(line, morePrefix) {
+			lines = append(lines, strip(line))
+			break
+		}
+		lines = append(lines, strings.TrimPrefix(line, morePrefix))
+	}
+	return serverPrefix + strings.Join(lines, "\n"), nil
+}
+
+// drop closes a broken connection. c.mu must be held.
+func (c *client) drop(err error) {
+	_ = c.conn.Close()
+	c.conn = nil
+	c.status(fmt.Sprintf("connection to %s lost: %v", c.addr, err))
+}
+
+// connect opens the first connection. When enclave-sim cannot be reached
+// it retries as redial does.
+func (c *client) connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.open()
+	if err == nil {
+		return nil
+	}
+	c.status(err.Error())
+	return c.redial()
+}
+
+// redial reconnects, waiting longer after every failed attempt. c.mu must
+// be held.
+func (c *client) redial() error {
+	wait := minBackoff
+	for attempt := 1; c.reconnects == 0 || attempt <= c.reconnects; attempt++ {
+		of := ""
+		if c.reconnects > 0 {
+			of = fmt.Sprintf(" of %d", c.reconnects)
+		}
+		c.status(fmt.Sprintf("reconnecting in %v (attempt %d%s)...", wait, attempt, of))
+		time.Sleep(wait)
+		err := c.open()
+		if err == nil {
+			c.gaveUp = false
+			c.status(fmt.Sprintf("reconnected to %s.", c.addr))
+			return nil
+		}
+		c.status(err.Error())
+		if wait *= 2; wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+	c.gaveUp = true
+	return errGaveUp
+}
+
+// refused reports whether enclave-sim refused the command.
+func refused(reply string) bool {
+	return strings.HasPrefix(strip(reply), refusedPrefix)
+}
+
+// strip removes the prefix from a reply.
+func strip(reply string) string {
+	return strings.TrimPrefix(reply, serverPrefix)
+}
+
+func (c *client) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// command is a command of the shell. Commands that are not local are
+// sent to enclave-sim.
+type command struct {
+	name    string
+	aliases []string
+	args    string // usage of the arguments
+	min     int    // number of arguments
+	max     int    // -1 for no limit
+	local   bool   // run by the shell instead of enclave-sim
+	summary string
+}
+
+var commands = []command{
+	{name: "buy", args: "<amount> [<asset> <price>]", min: 1, max: 3,
+		summary: "buy coins, or an asset paid for in the quote currency at the price"},
+	{name: "sell", args: "<amount> [<asset> <price>]", min: 1, max: 3,
+		summary: "sell coins, or an asset for the quote currency; refused if the holding is too low"},
+	{name: "bal", args: "[account]", max: 1, summary: "show the current balance, or that of another account"},
+	{name: "reload", summary: "restore the opening balance"},
+	{name: "transfer", args: "<toAccount> <amount> [asset] [memo]", min: 2, max: -1,
+		summary: "move coins, or another asset, to another account; refused if the holding is too low"},
+	{name: "explain", args: "<order>", min: 1, max: -1,
+		summary: "show how each risk and policy rule judges an order, without executing it"},
+	{name: "history", args: "[n]", max: 1, summary: "list the last n trades, 10 by default"},
+	{name: "statement", args: "[--from time] [--to time] [--page n]", max: 6,
+		summary: "list the trades between two times, such as 2006-01-02 or 2006-01-02T15:04, 20 a page"},
+	{name: "help", aliases: []string{"h"}, args: "[command]", max: 1, local: true, summary: "list the commands, or describe one"},
+	{name: "quit", aliases: []string{"q"}, local: true, summary: "close the connection and exit"},
+}
+
+// lookup returns the command with the given name or alias.
+func lookup(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+		for _, a := range c.aliases {
+			if a == name {
+				return c, true
+			}
+		}
+	}
+	return command{}, false
+}
+
+// parse splits a command line into the command and its arguments, and
+// checks the number of arguments.
+func parse(line string) (command, []string, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return command{}, nil, errors.New("empty command")
+	}
+	cmd, ok := lookup(fields[0])
+	if !ok {
+		return command{}, nil, fmt.Errorf("unknown command %q: enter 'help' for the list", fields[0])
+	}
+	args := fields[1:]
+	if len(args) < cmd.min || (cmd.max >= 0 && len(args) > cmd.max) {
+		return cmd, args, fmt.Errorf("usage: %s", cmd.usage())
+	}
+	return cmd, args, nil
+}
+
+// line returns the command line sent to enclave-sim.
+func (c command) line(args []string) string {
+	return strings.Join(append([]string{c.name}, args...), " ")
+}
+
+// usage returns the synopsis of the command.
+func (c command) usage() string {
+	return strings.TrimSpace(c.name + " " + c.args)
+}
+
+// complete is the tab completion for the shell: it completes the command
+// name, or the command named by help. It returns the completed line and
+// the names that could follow when more than one does.
+func complete(line string) (string, []string) {
+	fields := strings.Fields(line)
+	prefix := ""
+	if len(fields) > 0 && !strings.HasSuffix(line, " ") {
+		prefix = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) > 1 || (len(fields) == 1 && fields[0] != "help" && fields[0] != "h") {
+		return line, nil
+	}
+	var names []string
+	for _, c := range commands {
+		if strings.HasPrefix(c.name, prefix) {
+			names = append(names, c.name)
+		}
+	}
+	if len(names) == 0 {
+		return line, nil
+	}
+	sort.Strings(names)
+	head := strings.Join(append(fields, ""), " ")
+	if len(names) == 1 {
+		return head + names[0] + " ", nil
+	}
+	common := names[0]
+	for _, n := range names[1:] {
+		for !strings.HasPrefix(n, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	return head + common, names
+}
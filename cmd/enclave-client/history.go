@@ -0,0 +1,91 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// history is the command history of the shell, kept in a file so that it
+// survives the session. It implements term.History.
+type history struct {
+	path  string
+	max   int
+	lines []string // oldest first
+	err   error    // first error writing the file
+}
+
+// loadHistory reads the last max lines of the history file. A missing
+// file is an empty history.
+func loadHistory(path string, max int) (*history, error) {
+	h := &history{path: path, max: max}
+	if path == "" {
+		return h, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			h.lines = append(h.lines, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(h.lines) > max {
+		h.lines = h.lines[len(h.lines)-max:]
+		h.err = h.rewrite()
+	}
+	return h, nil
+}
+
+// Add appends the line to the history, unless it repeats the last one.
+func (h *history) Add(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || (len(h.lines) > 0 && h.lines[len(h.lines)-1] == line) {
+		return
+	}
+	h.lines = append(h.lines, line)
+	if len(h.lines) > h.max {
+		h.lines = h.lines[1:]
+	}
+	if h.path == "" || h.err != nil {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = f.WriteString(line + "\n")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	h.err = err
+}
+
+// Len returns the number of lines in the history.
+func (h *history) Len() int {
+	return len(h.lines)
+}
+
+// At returns the line i commands ago.
+func (h *history) At(i int) string {
+	return h.lines[len(h.lines)-1-i]
+}
+
+// rewrite replaces the file with the lines kept.
+func (h *history) rewrite() error {
+	return os.WriteFile(h.path, []byte(strings.Join(h.lines, "\n")+"\n"), 0600)
+}
@@ -5,14 +5,24 @@
 // enclave-client, which stands for pre-consensus, is used to illustrate
 // the idea of verifying orders before they are
 // added to the blockchain.
+//
+// Usage:
+//
+//	enclave-client [-i address] [-json]                 interactive shell
+//	enclave-client [-i address] [-json] exec <command>  send one command
+//	enclave-client [-i address] [-json] run <script>    run a script
+//
+// -config and -set select the config file and override its keys, as for
+// enclave-sim.
+//
+// exec and run exit with status 0 on success, 1 if the command was
+// refused or an assertion of the script failed and 2 on any other error.
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"strings"
 	"time"
@@ -21,55 +31,83 @@ import (
 )
 
 func main() {
+	log.SetFlags(0)
+	log.SetPrefix("enclave-client: ")
 	flagI := flag.String("i", "localhost", "Optional IP address")
+	asJSON := flag.Bool("json", false, "write JSON output from exec and run")
+	cflags := config.AddFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: enclave-client [flags] [exec <command> | run <script>]\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	serverConfig, err := cflags.Load()
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitTrouble)
+	}
 	tcpConnectString := func() string {
 		// If the user has entered an IP address on the commandline, then
 		// combine that address with the port found in the serverConfig file.
 		// If the user hasn't over-ridden the default ('localhost'), then
 		// use the connect string found in the serverConfig file.
-		serverConfig := config.NewConfig("config")
 		if *flagI != "localhost" {
-			return *flagI + ":" + serverConfig.GetString("TCPport")
+			return *flagI + ":" + serverConfig.Settings().TCPport
 		} else {
-			return serverConfig.GetString("TCPconnect")
+			return serverConfig.Settings().TCPconnect
 		}
 	}()
-	connection, err := net.Dial("tcp", tcpConnectString)
+	if flag.NArg() == 0 {
+		os.Exit(interactive(tcpConnectString, serverConfig))
+	}
+	// The flags may also follow the mode.
+	mode := flag.NewFlagSet(flag.Arg(0), flag.ExitOnError)
+	mode.BoolVar(asJSON, "json", *asJSON, "write JSON output")
+	_ = mode.Parse(flag.Args()[1:])
+	run := map[string]func(*client) int{
+		"exec": func(c *client) int { return execOne(c, strings.Join(mode.Args(), " "), *asJSON) },
+		"run":  func(c *client) int { return runScript(c, mode.Arg(0), *asJSON) },
+	}[flag.Arg(0)]
+	if run == nil || mode.NArg() == 0 || (flag.Arg(0) == "run" && mode.NArg() != 1) {
+		flag.Usage()
+		os.Exit(exitTrouble)
+	}
+	connection, err := dial(tcpConnectString, serverConfig.Settings().ClientTimeout)
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitTrouble)
+	}
+	status := run(connection)
+	_ = connection.close()
+	os.Exit(status)
+}
+
+// interactive runs the shell and returns its exit status. The first
+// connection is retried, and a lost connection is reopened.
+func interactive(addr string, cf *config.Config) int {
+	s := cf.Settings()
+	connection := &client{addr: addr, timeout: s.ClientTimeout, reconnect: true, reconnects: s.ClientReconnects,
+		status: func(msg string) { log.Print(msg) }}
+	if err := connection.connect(); err != nil {
+		log.Fatal(err)
+	}
+	hist, err := loadHistory(s.ClientHistory, s.ClientHistorySize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sh, err := newShell(hist)
 	if err != nil {
 		log.Fatal(err)
 	}
 	myTime := time.Now().Format(time.RFC3339)
-	fmt.Println("Connected to ENCLAVE SIMULATOR", myTime)
-	fmt.Println("Enter 'help' for usage hints.")
-	reader := bufio.NewReader(os.Stdin)
-	for {
-		fmt.Print("enclave-client> ")
-		text, _ := reader.ReadString('\n')
-		switch strings.TrimSpace(text) {
-		case "quit", "q":
-			fmt.Println("TCP" +
-				"enclave client exiting...")
-			os.Exit(0)
-		case "help", "h":
-			printHelp()
-			break
-		default:
-			// Send message to server.
-			_, _ = fmt.Fprintf(connection, text+"\n")
-			// Receive response from server.
-			message, _ := bufio.NewReader(connection).ReadString('\n')
-			// Print response.
-			fmt.Print(message)
-		}
+	sh.printf(sh.esc.Cyan, "Connected to ENCLAVE SIMULATOR %s\n", myTime)
+	sh.printf(nil, "Enter 'help' for usage hints.\n")
+	connection.status = sh.status
+	if every := s.ClientHeartbeat; every > 0 {
+		go connection.heartbeat(every)
 	}
-}
-
-func printHelp() {
-	const msg = `enclave-client commands:
-'buy' or 'sell' amount
-'reload'
-'bal' (retrieve current balance)
-'q' or 'quit'`
-	fmt.Println(msg)
+	// The connection is closed on exit, even while the heartbeat reconnects.
+	status := sh.run(connection)
+	sh.close()
+	return status
 }
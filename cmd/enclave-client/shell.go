@@ -0,0 +1,183 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const prompt = "enclave-client> "
+
+// shell reads commands from the user. On a terminal it edits lines,
+// recalls and completes commands and colors its output; otherwise it
+// reads plain lines.
+type shell struct {
+	readLine func() (string, error)
+	out      io.Writer
+	esc      *term.EscapeCodes
+	hist     *history
+	restore  func()
+}
+
+// newShell returns a shell on stdin and stdout. A terminal is in raw mode
+// until close is called.
+func newShell(hist *history) (*shell, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		r := bufio.NewReader(os.Stdin)
+		return &shell{
+			readLine: func() (string, error) {
+				fmt.Print(prompt)
+				return r.ReadString('\n')
+			},
+			out:     os.Stdout,
+			esc:     &term.EscapeCodes{},
+			hist:    hist,
+			restore: func() {},
+		}, nil
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+	t.SetPrompt(string(t.Escape.Cyan) + prompt + string(t.Escape.Reset))
+	t.History = hist
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' || pos != len(line) {
+			return "", 0, false
+		}
+		completed, names := complete(line)
+		if len(names) > 1 {
+			_, _ = fmt.Fprintln(t, strings.Join(names, "  "))
+		}
+		return completed, len(completed), true
+	}
+	return &shell{
+		readLine: t.ReadLine,
+		out:      t,
+		esc:      t.Escape,
+		hist:     hist,
+		restore:  func() { _ = term.Restore(fd, state) },
+	}, nil
+}
+
+// status reports a change of the connection.
+func (s *shell) status(msg string) {
+	s.printf(s.esc.Yellow, "%s\n", msg)
+}
+
+// close restores the terminal.
+func (s *shell) close() {
+	s.restore()
+}
+
+// run executes commands until the user quits or the connection is lost,
+// and returns the exit status.
+func (s *shell) run(c *client) int {
+	for {
+		line, err := s.readLine()
+		if s.hist.err != nil {
+			s.printf(s.esc.Yellow, "history not saved: %v\n", s.hist.err)
+			s.hist.path, s.hist.err = "", nil
+		}
+		eof := errors.Is(err, io.EOF)
+		if err != nil && !eof && !errors.Is(err, term.ErrPasteIndicator) {
+			s.printf(s.esc.Red, "%v\n", err)
+			return 1
+		}
+		if strings.TrimSpace(line) != "" {
+			if done, status := s.execute(c, line); done {
+				return status
+			}
+		}
+		if eof {
+			s.printf(nil, "\n")
+			return 0
+		}
+	}
+}
+
+// execute runs one command. It reports whether the shell is done, and
+// with which exit status.
+func (s *shell) execute(c *client, line string) (bool, int) {
+	if fields := strings.Fields(line); len(fields) == 2 && (fields[1] == "--help" || fields[1] == "-h") {
+		if cmd, ok := lookup(fields[0]); ok {
+			s.describe(cmd)
+			return false, 0
+		}
+	}
+	cmd, args, err := parse(line)
+	if err != nil {
+		s.printf(s.esc.Red, "%v\n", err)
+		return false, 0
+	}
+	switch cmd.name {
+	case "quit":
+		s.printf(nil, "enclave-client exiting...\n")
+		return true, 0
+	case "help":
+		if len(args) == 0 {
+			s.help()
+		} else if named, ok := lookup(args[0]); ok {
+			s.describe(named)
+		} else {
+			s.printf(s.esc.Red, "unknown command %q.\n", args[0])
+		}
+		return false, 0
+	}
+	reply, err := c.send(cmd.line(args))
+	if errors.Is(err, errGaveUp) {
+		s.printf(s.esc.Red, "%v.\n", err)
+		return true, 1
+	}
+	if err != nil {
+		s.printf(s.esc.Red, "%s: the command may not have been executed.\n", cmd.line(args))
+		return false, 0
+	}
+	color := s.esc.Green
+	if refused(reply) {
+		color = s.esc.Red
+	}
+	s.printf(color, "%s\n", reply)
+	return false, 0
+}
+
+// help lists the commands.
+func (s *shell) help() {
+	s.printf(s.esc.Cyan, "enclave-client commands:\n")
+	for _, c := range commands {
+		s.printf(nil, "  %-20s %s\n", c.usage(), c.summary)
+	}
+	s.printf(nil, "Enter '<command> --help' for details. Tab completes commands, ↑/↓ recall them.\n")
+}
+
+// describe prints the usage of the command.
+func (s *shell) describe(c command) {
+	s.printf(s.esc.Cyan, "usage: %s\n", c.usage())
+	s.printf(nil, "  %s\n", c.summary)
+	if len(c.aliases) > 0 {
+		s.printf(nil, "  also: %s\n", strings.Join(c.aliases, ", "))
+	}
+}
+
+// printf writes in the given color, or the default one if color is nil.
+func (s *shell) printf(color []byte, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if len(color) > 0 {
+		msg = string(color) + msg + string(s.esc.Reset)
+	}
+	_, _ = io.WriteString(s.out, msg)
+}
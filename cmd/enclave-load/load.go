@@ -0,0 +1,272 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// options are the parameters of a run.
+type options struct {
+	addr     string
+	conns    int
+	rate     float64
+	duration time.Duration
+	mix      []weight
+	amount   int
+	timeout  time.Duration
+}
+
+// weight is the share of a command in the mix.
+type weight struct {
+	cmd string
+	n   int
+}
+
+// parseMix parses weights such as "buy=45,sell=45,bal=10".
+func parseMix(s string) ([]weight, error) {
+	var mix []weight
+	for _, part := range strings.Split(s, ",") {
+		cmd, n, ok := strings.Cut(strings.TrimSpace(part), "=")
+		w, err := strconv.Atoi(n)
+		if !ok || err != nil || w < 0 {
+			return nil, fmt.Errorf("bad mix %q: want command=weight, ...", part)
+		}
+		if cmd != "buy" && cmd != "sell" && cmd != "bal" && cmd != "reload" {
+			return nil, fmt.Errorf("bad mix %q: unknown command %q", part, cmd)
+		}
+		mix = append(mix, weight{cmd, w})
+	}
+	total := 0
+	for _, w := range mix {
+		total += w.n
+	}
+	if total == 0 {
+		return nil, errors.New("bad mix: the weights add up to 0")
+	}
+	return mix, nil
+}
+
+// pick returns a random command line from the mix.
+func (o *options) pick(rnd *rand.Rand) string {
+	total := 0
+	for _, w := range o.mix {
+		total += w.n
+	}
+	n := rnd.Intn(total)
+	for _, w := range o.mix {
+		if n -= w.n; n < 0 {
+			if w.cmd == "buy" || w.cmd == "sell" {
+				return fmt.Sprintf("%s %d", w.cmd, 1+rnd.Intn(o.amount))
+			}
+			return w.cmd
+		}
+	}
+	panic("unreachable")
+}
+
+// report is the outcome of a run.
+type report struct {
+	Connections  int            `json:"connections"`
+	Duration     time.Duration  `json:"-"`
+	Seconds      float64        `json:"seconds"`
+	Served       int            `json:"served"` // connections that got a reply
+	Sent         int            `json:"sent"`
+	Answered     int            `json:"answered"`
+	Errors       int            `json:"errors"`
+	ErrorKinds   map[string]int `json:"errorKinds,omitempty"`
+	Throughput   float64        `json:"throughput"` // replies per second
+	Latency      latency        `json:"latencyMs"`
+	Commands     map[string]int `json:"commands"` // answered, by command
+	Trades       int            `json:"trades"`   // buy and sell answered
+	Blocked      int            `json:"blocked"`  // trades refused by enclave-sim
+	BlockedRatio float64        `json:"blockedRatio"`
+}
+
+// latency holds percentiles of the reply times, in milliseconds.
+type latency struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// tally is what one connection saw.
+type tally struct {
+	sent, answered, trades, blocked int
+	served                          bool
+	errors, commands                map[string]int
+	times                           []time.Duration
+}
+
+// run opens the connections and sends requests until the duration ends.
+func run(o options) *report {
+	var (
+		wg      sync.WaitGroup
+		tallies = make([]*tally, o.conns)
+		start   = time.Now()
+		end     = start.Add(o.duration)
+	)
+	for i := range tallies {
+		tallies[i] = &tally{errors: map[string]int{}, commands: map[string]int{}}
+		wg.Add(1)
+		go func(t *tally, seed int64) {
+			defer wg.Done()
+			trade(o, t, end, rand.New(rand.NewSource(seed)))
+		}(tallies[i], start.UnixNano()+int64(i))
+	}
+	wg.Wait()
+	return summarize(o, tallies, time.Since(start))
+}
+
+// trade is one trader: it sends requests at its share of the rate until
+// end, reconnecting after an error.
+func trade(o options, t *tally, end time.Time, rnd *rand.Rand) {
+	var interval time.Duration
+	if o.rate > 0 {
+		interval = time.Duration(float64(o.conns) / o.rate * float64(time.Second))
+	}
+	var (
+		conn net.Conn
+		r    *bufio.Reader
+	)
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+	next := time.Now()
+	for time.Now().Before(end) {
+		if interval > 0 {
+			time.Sleep(time.Until(next))
+			next = next.Add(interval)
+		}
+		if conn == nil {
+			var err error
+			if conn, err = net.DialTimeout("tcp", o.addr, o.timeout); err != nil {
+				t.errors[kind(err)]++
+				conn = nil
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			r = bufio.NewReader(conn)
+		}
+		line := o.pick(rnd)
+		deadline := time.Now().Add(o.timeout)
+		if deadline.After(end) {
+			deadline = end
+		}
+		_ = conn.SetDeadline(deadline)
+		sent := time.Now()
+		t.sent++
+		reply, err := roundTrip(conn, r, line)
+		if err != nil && !time.Now().Before(end) {
+			// Cut short by the end of the run.
+			t.sent--
+			break
+		}
+		if err != nil {
+			t.errors[kind(err)]++
+			_ = conn.Close()
+			conn = nil
+			continue
+		}
+		t.times = append(t.times, time.Since(sent))
+		t.answered++
+		t.served = true
+		cmd := strings.Fields(line)[0]
+		t.commands[cmd]++
+		if cmd == "buy" || cmd == "sell" {
+			t.trades++
+			if strings.HasPrefix(reply, "enclave-sim: refused: trade blocked") {
+				t.blocked++
+			}
+		}
+	}
+}
+
+func roundTrip(conn net.Conn, r *bufio.Reader, line string) (string, error) {
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		return "", err
+	}
+	return r.ReadString('\n')
+}
+
+// kind names the kind of an error for the report.
+func kind(err error) string {
+	var ne net.Error
+	switch {
+	case errors.As(err, &ne) && ne.Timeout(), errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, io.EOF):
+		return "connection closed"
+	case strings.Contains(err.Error(), "refused"):
+		return "connection refused"
+	case strings.Contains(err.Error(), "reset"):
+		return "connection reset"
+	}
+	return err.Error()
+}
+
+// summarize adds up the tallies of the connections.
+func summarize(o options, tallies []*tally, elapsed time.Duration) *report {
+	r := &report{
+		Connections: o.conns,
+		Duration:    elapsed.Round(time.Millisecond),
+		Seconds:     elapsed.Seconds(),
+		ErrorKinds:  map[string]int{},
+		Commands:    map[string]int{},
+	}
+	var times []time.Duration
+	for _, t := range tallies {
+		r.Sent += t.sent
+		r.Answered += t.answered
+		r.Trades += t.trades
+		r.Blocked += t.blocked
+		if t.served {
+			r.Served++
+		}
+		for k, n := range t.errors {
+			r.ErrorKinds[k] += n
+			r.Errors += n
+		}
+		for k, n := range t.commands {
+			r.Commands[k] += n
+		}
+		times = append(times, t.times...)
+	}
+	r.Throughput = float64(r.Answered) / elapsed.Seconds()
+	if r.Trades > 0 {
+		r.BlockedRatio = float64(r.Blocked) / float64(r.Trades)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	r.Latency = latency{P50: percentile(times, 50), P90: percentile(times, 90), P99: percentile(times, 99),
+		Max: percentile(times, 100)}
+	return r
+}
+
+// percentile returns the p'th percentile of the sorted times, in
+// milliseconds, by the nearest rank.
+func percentile(sorted []time.Duration, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (p*len(sorted)+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
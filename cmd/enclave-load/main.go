@@ -0,0 +1,93 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+// enclave-load drives enclave-sim with many concurrent traders and
+// reports throughput, latency, errors and the share of blocked trades.
+//
+// enclave-sim serves the connections at once and executes their orders one
+// at a time. The report counts the connections that were served.
+//
+// Exit status is 0 when every request was answered, 1 when some were not
+// and 2 on any other error.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/config"
+)
+
+const (
+	exitOK     = 0
+	exitErrors = 1
+	exitError  = 2
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("enclave-load: ")
+	cf := config.NewConfig("config")
+	var o options
+	flag.StringVar(&o.addr, "addr", cf.Settings().TCPconnect, "enclave-sim address")
+	flag.IntVar(&o.conns, "c", 10, "concurrent connections")
+	flag.Float64Var(&o.rate, "rate", 100, "target requests per second over all connections; 0 sends as fast as replies arrive")
+	flag.DurationVar(&o.duration, "d", 10*time.Second, "duration of the run")
+	mix := flag.String("mix", "buy=45,sell=45,bal=10", "relative weights of the commands")
+	flag.IntVar(&o.amount, "amount", 100, "largest amount bought or sold; amounts are random from 1")
+	flag.DurationVar(&o.timeout, "timeout", 5*time.Second, "time to wait for a reply")
+	asJSON := flag.Bool("json", false, "write JSON output")
+	flag.Parse()
+
+	var err error
+	if o.mix, err = parseMix(*mix); err != nil {
+		log.Print(err)
+		os.Exit(exitError)
+	}
+	if o.conns < 1 || o.amount < 1 || o.rate < 0 || o.duration <= 0 {
+		log.Print("-c, -amount and -d must be positive, and -rate not negative")
+		os.Exit(exitError)
+	}
+	r := run(o)
+	if *asJSON {
+		_ = json.NewEncoder(os.Stdout).Encode(r)
+	} else {
+		r.print()
+	}
+	if r.Errors > 0 {
+		os.Exit(exitErrors)
+	}
+	os.Exit(exitOK)
+}
+
+// print writes the report for people.
+func (r *report) print() {
+	fmt.Printf("%d connections for %v, %d served by enclave-sim\n", r.Connections, r.Duration, r.Served)
+	fmt.Printf("requests:   %d sent, %d answered, %d errors\n", r.Sent, r.Answered, r.Errors)
+	for _, k := range sortedKeys(r.ErrorKinds) {
+		fmt.Printf("            %d %s\n", r.ErrorKinds[k], k)
+	}
+	fmt.Printf("throughput: %.1f replies/s\n", r.Throughput)
+	fmt.Printf("latency:    p50 %.2fms  p90 %.2fms  p99 %.2fms  max %.2fms\n", r.Latency.P50, r.Latency.P90,
+		r.Latency.P99, r.Latency.Max)
+	fmt.Printf("commands:  ")
+	for _, k := range sortedKeys(r.Commands) {
+		fmt.Printf(" %d %s", r.Commands[k], k)
+	}
+	fmt.Printf("\ntrades:     %d answered, %d blocked (%.1f%%)\n", r.Trades, r.Blocked, 100*r.BlockedRatio)
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,276 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+// enclave-sgx inspects an enclave directory and manages the signed
+// baseline manifest that enclave-sim uses as its trusted state.
+//
+// Exit status is 0 when the enclave matches its baseline, 1 when it has
+// been tampered with and 2 on any other error.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/config"
+	"github.com/donaldww/idemo2/internal/sgx"
+)
+
+const (
+	exitOK       = 0
+	exitTampered = 1
+	exitError    = 2
+)
+
+const usage = `usage: enclave-sgx <command> [flags]
+
+commands:
+  keygen    create an operator key pair
+  scan      list every item in the enclave
+  baseline  scan the enclave and write a signed manifest
+  verify    check the enclave against the signed manifest
+  diff      list every discrepancy between the manifest and the enclave
+  watch     report discrepancies as the enclave changes
+
+Run 'enclave-sgx <command> -h' for the flags of each command.`
+
+// options are the flags shared by every command.
+type options struct {
+	root     string
+	manifest string
+	pubKey   string
+	json     bool
+}
+
+func newFlagSet(name string, cf *config.Config) (*flag.FlagSet, *options) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &options{}
+	fs.StringVar(&o.root, "root", cf.Bin(), "enclave directory")
+	fs.StringVar(&o.manifest, "manifest", cf.Settings().SgxManifest, "baseline manifest")
+	fs.StringVar(&o.pubKey, "pubkey", cf.Settings().SgxPublicKey, "operator public key")
+	fs.BoolVar(&o.json, "json", false, "write JSON output")
+	return fs, o
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("enclave-sgx: ")
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(exitError)
+	}
+	cf := config.NewConfig("config")
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "keygen":
+		keygen(cf, args)
+	case "scan":
+		scan(cf, args)
+	case "baseline":
+		baseline(cf, args)
+	case "verify":
+		verify(cf, args)
+	case "diff":
+		diff(cf, args)
+	case "watch":
+		watch(cf, args)
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(exitError)
+	}
+}
+
+// fatal logs err and exits with exitError.
+func fatal(err error) {
+	log.Print(err)
+	os.Exit(exitError)
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fatal(err)
+	}
+}
+
+// printChanges writes changes and returns the exit status they imply.
+func printChanges(o *options, changes []sgx.Change) int {
+	if o.json {
+		if changes == nil {
+			changes = []sgx.Change{}
+		}
+		printJSON(changes)
+	} else if len(changes) == 0 {
+		fmt.Println("SGX SIMULATOR ENCLAVE: Verified.")
+	} else {
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+	}
+	if len(changes) > 0 {
+		return exitTampered
+	}
+	return exitOK
+}
+
+// loadEnclave verifies the signed manifest and returns an enclave that
+// uses it as its baseline.
+func loadEnclave(o *options, opts ...sgx.Option) *sgx.Enclave {
+	en := sgx.New(o.root, opts...)
+	if err := en.LoadBaseline(o.manifest, o.pubKey); err != nil {
+		fatal(err)
+	}
+	return en
+}
+
+func keygen(cf *config.Config, args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	force := fs.Bool("f", false, "overwrite an existing key pair")
+	priv := fs.String("key", cf.Settings().SgxPrivateKey, "operator private key")
+	pub := fs.String("pubkey", cf.Settings().SgxPublicKey, "operator public key")
+	_ = fs.Parse(args)
+	if _, err := os.Stat(*priv); err == nil && !*force {
+		fatal(fmt.Errorf("%s already exists (use -f to overwrite)", *priv))
+	}
+	if err := sgx.GenerateKey(*priv, *pub); err != nil {
+		fatal(err)
+	}
+	fmt.Println("wrote", *priv, "and", *pub)
+}
+
+func scan(cf *config.Config, args []string) {
+	fs, o := newFlagSet("scan", cf)
+	_ = fs.Parse(args)
+	m, err := sgx.NewManifest(o.root)
+	if err != nil {
+		fatal(err)
+	}
+	if o.json {
+		printJSON(m)
+		return
+	}
+	for _, e := range m.Entries {
+		hash := e.SHA256
+		if hash == "" {
+			hash = "-"
+		}
+		fmt.Printf("%s %10d %-64s %s\n", e.Mode, e.Size, hash, e.Path)
+	}
+}
+
+func baseline(cf *config.Config, args []string) {
+	fs, o := newFlagSet("baseline", cf)
+	priv := fs.String("key", cf.Settings().SgxPrivateKey, "operator private key")
+	_ = fs.Parse(args)
+	key, err := sgx.LoadPrivateKey(*priv)
+	if err != nil {
+		fatal(err)
+	}
+	m, err := sgx.NewManifest(o.root)
+	if err != nil {
+		fatal(err)
+	}
+	if err := m.Sign(key); err != nil {
+		fatal(err)
+	}
+	if err := m.WriteManifest(o.manifest); err != nil {
+		fatal(err)
+	}
+	if o.json {
+		printJSON(map[string]interface{}{"manifest": o.manifest, "items": len(m.Entries)})
+		return
+	}
+	fmt.Printf("wrote %s: %d items\n", o.manifest, len(m.Entries))
+}
+
+func verify(cf *config.Config, args []string) {
+	fs, o := newFlagSet("verify", cf)
+	_ = fs.Parse(args)
+	en := loadEnclave(o)
+	if err := en.Scan(); err != nil {
+		fatal(err)
+	}
+	changes := en.Diff()
+	if o.json {
+		printJSON(map[string]interface{}{"verified": len(changes) == 0, "discrepancies": len(changes)})
+	} else if len(changes) == 0 {
+		fmt.Println("SGX SIMULATOR ENCLAVE: Verified.")
+	} else {
+		fmt.Printf("SGX SIMULATOR ENCLAVE: %d discrepancies, run 'enclave-sgx diff' for details.\n",
+			len(changes))
+	}
+	if len(changes) > 0 {
+		os.Exit(exitTampered)
+	}
+}
+
+func diff(cf *config.Config, args []string) {
+	fs, o := newFlagSet("diff", cf)
+	against := fs.String("against", "", "compare with this manifest instead of scanning the enclave")
+	_ = fs.Parse(args)
+	if *against == "" {
+		en := loadEnclave(o)
+		if err := en.Scan(); err != nil {
+			fatal(err)
+		}
+		os.Exit(printChanges(o, en.Diff()))
+	}
+	old, err := sgx.ReadManifest(o.manifest)
+	if err != nil {
+		fatal(err)
+	}
+	pub, err := sgx.LoadPublicKey(o.pubKey)
+	if err != nil {
+		fatal(err)
+	}
+	if err := old.Verify(pub); err != nil {
+		fatal(err)
+	}
+	cur, err := sgx.ReadManifest(*against)
+	if err != nil {
+		fatal(err)
+	}
+	os.Exit(printChanges(o, sgx.DiffManifests(old, cur)))
+}
+
+func watch(cf *config.Config, args []string) {
+	fs, o := newFlagSet("watch", cf)
+	debounce := fs.Duration("debounce", cf.Settings().SgxDebounce, "wait for events to settle")
+	rescan := fs.Duration("rescan", cf.Settings().SgxRescan, "full rescan interval")
+	_ = fs.Parse(args)
+	en := loadEnclave(o, sgx.WithDebounce(*debounce), sgx.WithRescan(*rescan))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	status := exitOK
+	err := en.Watch(ctx, func(changes []sgx.Change) {
+		status = exitOK
+		if len(changes) > 0 {
+			status = exitTampered
+		}
+		if o.json {
+			if changes == nil {
+				changes = []sgx.Change{}
+			}
+			_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+				"time": time.Now().UTC().Format(time.RFC3339), "changes": changes})
+			return
+		}
+		fmt.Println(time.Now().Format(time.RFC3339))
+		printChanges(&options{}, changes)
+	})
+	stop()
+	if err != nil {
+		fatal(err)
+	}
+	// Exit reflecting the last state seen before the interrupt.
+	os.Exit(status)
+}
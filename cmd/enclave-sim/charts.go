@@ -0,0 +1,160 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/events"
+	"github.com/mum4k/termdash/cell"
+	"github.com/mum4k/termdash/widgets/barchart"
+	"github.com/mum4k/termdash/widgets/linechart"
+	"github.com/mum4k/termdash/widgets/sparkline"
+)
+
+// charts draws the events published by the simulation, keeping those
+// that happened within the last window.
+type charts struct {
+	window   time.Duration
+	txs      *barchart.BarChart
+	interval *sparkline.SparkLine
+	balance  *linechart.LineChart
+	latency  *sparkline.SparkLine
+	// The events shown, oldest first.
+	blocks, balances, scans []events.Event
+}
+
+// newCharts creates the chart widgets.
+func newCharts(window time.Duration) (*charts, error) {
+	c := &charts{window: window}
+	var err error
+	c.txs, err = barchart.New(
+		barchart.BarColors([]cell.Color{cell.ColorBlue}),
+		barchart.BarGap(1),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.interval, err = sparkline.New(sparkline.Color(cell.ColorGreen))
+	if err != nil {
+		return nil, err
+	}
+	c.balance, err = linechart.New(
+		linechart.AxesCellOpts(cell.FgColor(cell.ColorCyan)),
+		linechart.YLabelCellOpts(cell.FgColor(cell.ColorCyan)),
+		linechart.XLabelCellOpts(cell.FgColor(cell.ColorCyan)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.latency, err = sparkline.New(sparkline.Color(cell.ColorYellow))
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// run draws the events received on ch until the context expires. Old
+// events are dropped once a second.
+func (c *charts) run(ctx context.Context, ch <-chan events.Event) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-ch:
+			switch e.Kind {
+			case events.Block:
+				c.blocks = append(c.blocks, e)
+			case events.Balance:
+				c.balances = append(c.balances, e)
+			case events.Scan:
+				c.scans = append(c.scans, e)
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		c.prune(time.Now().Add(-c.window))
+		if err := c.draw(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// prune drops the events older than since. The latest balance is kept,
+// so the chart still shows the balance when nobody has traded.
+func (c *charts) prune(since time.Time) {
+	drop := func(list []events.Event, keep int) []events.Event {
+		i := 0
+		for i < len(list)-keep && list[i].Time.Before(since) {
+			i++
+		}
+		return list[i:]
+	}
+	c.blocks = drop(c.blocks, 0)
+	c.balances = drop(c.balances, 1)
+	c.scans = drop(c.scans, 0)
+}
+
+func (c *charts) draw() error {
+	if err := c.drawBlocks(); err != nil {
+		return err
+	}
+	if len(c.balances) > 0 {
+		values := make([]float64, len(c.balances))
+		labels := make(map[int]string, len(c.balances))
+		for i, e := range c.balances {
+			values[i] = e.Value
+			labels[i] = e.Time.Format("15:04:05")
+		}
+		if err := c.balance.Series("balance", values,
+			linechart.SeriesCellOpts(cell.FgColor(cell.ColorRed)),
+			linechart.SeriesXLabels(labels),
+		); err != nil {
+			return err
+		}
+	}
+	c.latency.Clear()
+	if len(c.scans) > 0 {
+		values := make([]int, len(c.scans))
+		for i, e := range c.scans {
+			values[i] = int(e.Value * 1000) // microseconds
+		}
+		last := time.Duration(values[len(values)-1]) * time.Microsecond
+		return c.latency.Add(values, sparkline.Label(fmt.Sprintf("last scan %v", last)))
+	}
+	return nil
+}
+
+// drawBlocks draws the transactions per block, as many as fit, and the
+// intervals between the blocks.
+func (c *charts) drawBlocks() error {
+	blocks := c.blocks
+	if n := c.txs.ValueCapacity(); n > 0 && len(blocks) > n {
+		blocks = blocks[len(blocks)-n:]
+	}
+	values, max := make([]int, len(blocks)), 1
+	for i, e := range blocks {
+		values[i] = int(e.Value)
+		if values[i] > max {
+			max = values[i]
+		}
+	}
+	if err := c.txs.Values(values, max); err != nil {
+		return err
+	}
+	c.interval.Clear()
+	if len(c.blocks) < 2 {
+		return nil
+	}
+	intervals := make([]int, len(c.blocks)-1)
+	for i := range intervals {
+		intervals[i] = int(c.blocks[i+1].Time.Sub(c.blocks[i].Time).Milliseconds())
+	}
+	last := time.Duration(intervals[len(intervals)-1]) * time.Millisecond
+	return c.interval.Add(intervals, sparkline.Label(fmt.Sprintf("last block %v", last)))
+}
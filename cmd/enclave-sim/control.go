@@ -0,0 +1,127 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxSpeed bounds the speed levels either way: the animations run at
+// most 2^maxSpeed times faster or slower than configured.
+const maxSpeed = 3
+
+// control is the state of the simulation changed from the keyboard.
+// It is safe for concurrent use.
+type control struct {
+	mu     sync.Mutex
+	paused bool // block production is paused
+	steps  int  // blocks still to produce while paused
+	speed  int  // animations run 2^speed times faster
+	wake   chan struct{}
+	leader chan struct{}
+}
+
+func newControl() *control {
+	return &control{wake: make(chan struct{}), leader: make(chan struct{}, 1)}
+}
+
+// changed wakes the goroutines waiting in gate. c.mu must be held.
+func (c *control) changed() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+// togglePause pauses or resumes block production and reports whether it
+// is now paused.
+func (c *control) togglePause() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused, c.steps = !c.paused, 0
+	c.changed()
+	return c.paused
+}
+
+// step lets one more block through while paused. It reports false if
+// production is not paused.
+func (c *control) step() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused {
+		return false
+	}
+	c.steps++
+	c.changed()
+	return true
+}
+
+// gate blocks while production is paused and no step is pending. It
+// returns false if the context expires first.
+func (c *control) gate(ctx context.Context) bool {
+	for {
+		c.mu.Lock()
+		if !c.paused || c.steps > 0 {
+			c.mu.Unlock()
+			return true
+		}
+		wake := c.wake
+		c.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// produced uses up a pending step once a block has been collected.
+func (c *control) produced() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.steps > 0 {
+		c.steps--
+	}
+}
+
+// faster changes the speed of the animations by n levels and returns the
+// new speed.
+func (c *control) faster(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.speed += n
+	if c.speed > maxSpeed {
+		c.speed = maxSpeed
+	}
+	if c.speed < -maxSpeed {
+		c.speed = -maxSpeed
+	}
+	return c.speed
+}
+
+// scale returns the animation delay d adjusted for the speed.
+func (c *control) scale(d time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.speed >= 0 {
+		return d >> c.speed
+	}
+	return d << -c.speed
+}
+
+// changeLeader asks the consensus group for a new leader.
+func (c *control) changeLeader() {
+	select {
+	case c.leader <- struct{}{}:
+	default:
+	}
+}
+
+// state returns what the title bar shows.
+func (c *control) state() (paused bool, speed int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused, c.speed
+}
@@ -0,0 +1,220 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/blockchain"
+	"github.com/donaldww/idemo2/internal/events"
+	"github.com/donaldww/idemo2/internal/term"
+	"github.com/mum4k/termdash/cell"
+	"github.com/mum4k/termdash/widgets/text"
+)
+
+// listLines is how many blocks above the cursor are written into the
+// list; the widget rolls its content and shows those that fit.
+const listLines = 200
+
+// inspector lists the blocks in the Blockchain Tail Monitor and shows the
+// block under the cursor in detail. The cursor follows the newest block
+// until it is moved. It is safe for concurrent use.
+type inspector struct {
+	mu     sync.Mutex
+	list   *text.Text
+	detail *text.Text
+	blocks []blockchain.Block
+	valid  []bool // validation result of each block, which never changes
+	cursor int
+	follow bool
+	open   bool
+}
+
+func newInspector() (*inspector, error) {
+	list, err := text.New(text.RollContent())
+	if err != nil {
+		return nil, err
+	}
+	detail, err := text.New(text.WrapAtRunes())
+	if err != nil {
+		return nil, err
+	}
+	return &inspector{list: list, detail: detail, follow: true}, nil
+}
+
+// run redraws the list when a block is added, and once a second until
+// the genesis block shows up. Exits when the context expires.
+func (in *inspector) run(ctx context.Context, ch <-chan events.Event) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-ch:
+			if e.Kind != events.Block {
+				continue
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		in.refresh()
+	}
+}
+
+// refresh picks up new blocks and redraws.
+func (in *inspector) refresh() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	blocks := blockchain.Blocks()
+	if len(blocks) == len(in.blocks) {
+		return
+	}
+	for i := len(in.valid); i < len(blocks); i++ {
+		ok := true
+		for _, c := range blockchain.Validate(i) {
+			ok = ok && c.OK
+		}
+		in.valid = append(in.valid, ok)
+	}
+	in.blocks = blocks
+	if in.follow {
+		in.cursor = len(blocks) - 1
+	}
+	in.draw()
+}
+
+// move moves the cursor n blocks towards the newest.
+func (in *inspector) move(n int) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.blocks) == 0 {
+		return
+	}
+	in.cursor += n
+	if in.cursor < 0 {
+		in.cursor = 0
+	}
+	if in.cursor >= len(in.blocks)-1 {
+		in.cursor = len(in.blocks) - 1
+	}
+	in.follow = in.cursor == len(in.blocks)-1
+	in.draw()
+}
+
+// setOpen records whether the detail is shown, and draws it if so.
+func (in *inspector) setOpen(open bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.open = open
+	in.draw()
+}
+
+func (in *inspector) isOpen() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.open
+}
+
+func (in *inspector) draw() {
+	if in.open {
+		in.drawDetail()
+	}
+	in.drawList()
+}
+
+// drawList writes one line per block, highlighting the cursor. Blocks
+// after the cursor are left out, so the rolling widget keeps it in view.
+func (in *inspector) drawList() {
+	in.list.Reset()
+	begin := in.cursor - listLines
+	if begin < 0 {
+		begin = 0
+	}
+	for i := begin; i <= in.cursor && i < len(in.blocks); i++ {
+		b := in.blocks[i]
+		color := cell.ColorDefault
+		if i%2 == 1 {
+			color = cell.ColorMagenta
+		}
+		opts := []cell.Option{cell.FgColor(color)}
+		if i == in.cursor {
+			opts = []cell.Option{cell.FgColor(cell.ColorBlack), cell.BgColor(cell.ColorCyan)}
+		}
+		mark := "✓"
+		if !in.valid[i] {
+			mark, opts = "✗", append(opts, cell.FgColor(cell.ColorRed))
+		}
+		line := fmt.Sprintf("#%-5d %s %5d tx %s %s", b.Nonce, short(b.Hash), b.NumberOfTransactions,
+			mark, b.ConsensusLeader)
+		if i > begin {
+			_ = in.list.Write("\n")
+		}
+		term.WriteColorf(in.list, cell.ColorRed, " 💰 ")
+		_ = in.list.Write(line, text.WriteCellOpts(opts...))
+	}
+}
+
+// drawDetail shows the result of each validation rule, every field of the
+// block under the cursor and the orders it records. The long signature
+// comes last, as the panel may be too short to show all of it.
+func (in *inspector) drawDetail() {
+	t := in.detail
+	t.Reset()
+	if len(in.blocks) == 0 {
+		return
+	}
+	b := in.blocks[in.cursor]
+	term.WriteColorf(t, cell.ColorBlue, " BLOCK %d of %d ", b.Nonce, len(in.blocks)-1)
+	if in.valid[in.cursor] {
+		term.WriteColorf(t, cell.ColorGreen, "VALID")
+	} else {
+		term.WriteColorf(t, cell.ColorRed, "INVALID")
+	}
+	term.WriteColorf(t, cell.ColorBlue, " (↑/↓ select, Enter or Esc closes)\n")
+	for _, c := range blockchain.Validate(in.cursor) {
+		if c.OK {
+			term.WriteColorf(t, cell.ColorGreen, " ✓ %s\n", c.Rule)
+		} else {
+			term.WriteColorf(t, cell.ColorRed, " ✗ %s\n", c.Rule)
+		}
+	}
+	for _, f := range [][2]string{
+		{"Height", fmt.Sprint(b.Nonce)},
+		{"Leader", b.ConsensusLeader},
+		{"Timestamp", b.Timestamp},
+		{"Transactions", fmt.Sprint(b.NumberOfTransactions)},
+		{"Orders", fmt.Sprint(len(b.Transactions))},
+		{"Data", orNone(b.Data)},
+		{"Hash", b.Hash},
+		{"Previous hash", orNone(b.PrevHash)},
+	} {
+		term.WriteColorf(t, cell.ColorCyan, " %-14s", f[0])
+		term.WriteColorf(t, cell.ColorDefault, " %s\n", f[1])
+	}
+	for i, tx := range b.Transactions {
+		term.WriteColorf(t, cell.ColorCyan, " %-14s", fmt.Sprintf("Order %d", i+1))
+		term.WriteColorf(t, cell.ColorDefault, " %s\n", tx)
+	}
+	term.WriteColorf(t, cell.ColorCyan, " %-14s", "Signature")
+	term.WriteColorf(t, cell.ColorDefault, " %s\n", b.Signature)
+}
+
+// short abbreviates a hash.
+func short(hash string) string {
+	if len(hash) <= 12 {
+		return fmt.Sprintf("%-13s", hash)
+	}
+	return hash[:6] + "…" + hash[len(hash)-6:]
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
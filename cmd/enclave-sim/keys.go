@@ -0,0 +1,340 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/donaldww/idemo2/internal/logger"
+	"github.com/donaldww/idemo2/internal/sgx"
+	"github.com/donaldww/idemo2/internal/term"
+	"github.com/mum4k/termdash/cell"
+	cr "github.com/mum4k/termdash/container"
+	"github.com/mum4k/termdash/keyboard"
+	"github.com/mum4k/termdash/terminal/terminalapi"
+	"github.com/mum4k/termdash/widgets/text"
+)
+
+// rootID identifies the outer container, whose title shows the view state.
+const rootID = "root"
+
+// pageLines is how far PgUp and PgDn scroll.
+const pageLines = 10
+
+// bindings are listed by the help overlay.
+var bindings = []struct{ keys, action string }{
+	{"Space", "pause or resume block production"},
+	{"s", "produce one block while paused"},
+	{"+ / -", "speed up or slow down the animations"},
+	{"l", "force a new consensus group leader"},
+	{"r", "rescan the enclave now"},
+	{"1-9, 0", "hide or show a panel (listed below)"},
+	{"↑ / ↓", "select a block in the Blockchain Tail Monitor"},
+	{"Enter / Esc", "open or close the selected block"},
+	{"Tab", "select the log pane to scroll"},
+	{"PgUp / PgDn", "scroll the selected pane; End returns to the bottom"},
+	{"/", "search the selected pane; n / N for older / newer matches"},
+	{"p", "freeze or unfreeze every pane"},
+	{"?", "show this help; any key closes it"},
+	{"q", "quit"},
+}
+
+// namedPane is a pane that can be scrolled, searched and frozen. It is
+// shown by the layout panel of the same name.
+type namedPane struct {
+	panel string
+	name  string
+	pane  *term.Pane
+}
+
+// viewKeys handles the keys that control the simulation and the view.
+type viewKeys struct {
+	c         *cr.Container
+	title     string
+	layout    *layout
+	panels    map[string]panel
+	hidden    map[string]bool
+	help      *text.Text
+	helpShown bool
+	ctl       *control
+	enclave   *sgx.Enclave
+	blocks    *inspector
+	panes     []namedPane
+	focus     int
+	paused    bool
+	searching bool
+	query     []rune
+	status    string
+	quit      func()
+}
+
+// handle is the termdash keyboard subscriber.
+func (v *viewKeys) handle(k *terminalapi.Keyboard) {
+	if v.helpShown {
+		if k.Key == 'q' || k.Key == 'Q' {
+			v.quit()
+			return
+		}
+		v.helpShown = false
+		v.relayout()
+		return
+	}
+	if v.searching {
+		v.searchKey(k)
+		return
+	}
+	log := logger.For(logger.Consensus)
+	v.status = ""
+	switch k.Key {
+	case 'q', 'Q':
+		v.quit()
+		return
+	case '?':
+		v.showHelp()
+		return
+	case keyboard.KeySpace:
+		if v.ctl.togglePause() {
+			log.Info("block production paused.")
+		} else {
+			log.Info("block production resumed.")
+		}
+	case 's':
+		if !v.ctl.step() {
+			v.status = "pause block production first"
+		}
+	case '+', '=':
+		v.ctl.faster(1)
+	case '-':
+		v.ctl.faster(-1)
+	case 'l':
+		v.ctl.changeLeader()
+	case 'r':
+		v.enclave.RequestScan()
+		logger.For(logger.SGX).Info("SGX SIMULATOR ENCLAVE: rescan requested.")
+	case '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		v.togglePanel(int(k.Key - '1'))
+	case '0':
+		v.togglePanel(9)
+	default:
+		if !v.blockKey(k) && !v.paneKey(k) {
+			return
+		}
+	}
+	v.updateTitle()
+}
+
+// blockKey handles the keys that select and open blocks in the Blockchain
+// Tail Monitor. It reports whether k was one of them.
+func (v *viewKeys) blockKey(k *terminalapi.Keyboard) bool {
+	if !v.layout.has("blockchain") || v.hidden["blockchain"] {
+		return false
+	}
+	switch k.Key {
+	case keyboard.KeyArrowUp:
+		v.blocks.move(-1)
+	case keyboard.KeyArrowDown:
+		v.blocks.move(1)
+	case keyboard.KeyEnter:
+		v.openBlock(!v.blocks.isOpen())
+	case keyboard.KeyEsc:
+		v.openBlock(false)
+	default:
+		return false
+	}
+	return true
+}
+
+// openBlock shows the detail of the selected block in place of the list,
+// or the list again.
+func (v *viewKeys) openBlock(open bool) {
+	w := v.blocks.list
+	if open {
+		w = v.blocks.detail
+	}
+	if err := v.c.Update("blockchain", cr.PlaceWidget(w)); err != nil {
+		v.status = err.Error()
+		return
+	}
+	v.blocks.setOpen(open)
+}
+
+// paneKey handles the keys that scroll, search and freeze the panes. It
+// reports whether k was one of them.
+func (v *viewKeys) paneKey(k *terminalapi.Keyboard) bool {
+	if !v.visible(v.focus) {
+		return false
+	}
+	p := v.panes[v.focus].pane
+	switch k.Key {
+	case keyboard.KeyTab:
+		v.nextPane()
+	case keyboard.KeyPgUp:
+		p.Scroll(pageLines)
+	case keyboard.KeyPgDn:
+		p.Scroll(-pageLines)
+	case keyboard.KeyEnd:
+		p.Bottom()
+	case '/':
+		v.searching, v.query = true, nil
+	case 'n':
+		if !p.Next(true) {
+			v.status = "no older match"
+		}
+	case 'N':
+		if !p.Next(false) {
+			v.status = "no newer match"
+		}
+	case 'p', 'P':
+		v.paused = !v.paused
+		for _, np := range v.panes {
+			np.pane.SetPaused(v.paused)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// visible reports whether pane i is shown.
+func (v *viewKeys) visible(i int) bool {
+	return i < len(v.panes) && v.layout.has(v.panes[i].panel) && !v.hidden[v.panes[i].panel]
+}
+
+// nextPane moves the focus to the next pane shown, if any.
+func (v *viewKeys) nextPane() {
+	for range v.panes {
+		v.focus = (v.focus + 1) % len(v.panes)
+		if v.visible(v.focus) {
+			return
+		}
+	}
+}
+
+// searchKey edits the search prompt.
+func (v *viewKeys) searchKey(k *terminalapi.Keyboard) {
+	p := v.panes[v.focus].pane
+	switch k.Key {
+	case keyboard.KeyEnter:
+		v.searching = false
+		if !p.Search(string(v.query)) {
+			v.status = "no match"
+		}
+	case keyboard.KeyEsc:
+		v.searching = false
+		p.Search("")
+	case keyboard.KeyBackspace, keyboard.KeyBackspace2:
+		if len(v.query) > 0 {
+			v.query = v.query[:len(v.query)-1]
+		}
+	default:
+		if k.Key >= keyboard.KeySpace {
+			v.query = append(v.query, rune(k.Key))
+		}
+	}
+	v.updateTitle()
+}
+
+// togglePanel hides or shows the i'th panel of the layout. The last panel
+// shown cannot be hidden.
+func (v *viewKeys) togglePanel(i int) {
+	names := v.layout.panels()
+	if i >= len(names) {
+		v.status = fmt.Sprintf("no panel %d", i+1)
+		return
+	}
+	name := names[i]
+	if !v.hidden[name] && len(v.hidden) == len(names)-1 {
+		v.status = "cannot hide the last panel"
+		return
+	}
+	if v.hidden[name] {
+		delete(v.hidden, name)
+	} else {
+		v.hidden[name] = true
+	}
+	if !v.visible(v.focus) {
+		v.nextPane()
+	}
+	v.relayout()
+}
+
+// relayout places the panels that are not hidden. The block list is shown
+// again in place of an open block.
+func (v *viewKeys) relayout() {
+	v.blocks.setOpen(false)
+	opts, err := v.layout.without(v.hidden).build(v.panels)
+	if err == nil {
+		err = v.c.Update(rootID, append([]cr.Option{cr.Clear()}, opts...)...)
+	}
+	if err != nil {
+		v.status = err.Error()
+	}
+	v.updateTitle()
+}
+
+// showHelp replaces the panels with the list of key bindings.
+func (v *viewKeys) showHelp() {
+	v.help.Reset()
+	term.WriteColorf(v.help, cell.ColorBlue, "\n KEYS\n\n")
+	for _, b := range bindings {
+		term.WriteColorf(v.help, cell.ColorRed, " %-12s", b.keys)
+		term.WriteColorf(v.help, cell.ColorDefault, " %s\n", b.action)
+	}
+	term.WriteColorf(v.help, cell.ColorBlue, "\n PANELS\n\n")
+	for i, name := range v.layout.panels() {
+		state := "shown"
+		if v.hidden[name] {
+			state = "hidden"
+		}
+		term.WriteColorf(v.help, cell.ColorRed, " %-12s", panelKey(i))
+		term.WriteColorf(v.help, cell.ColorDefault, " %s (%s)\n", name, state)
+	}
+	if err := v.c.Update(rootID, cr.Clear(), cr.PlaceWidget(v.help)); err != nil {
+		v.status = err.Error()
+		v.updateTitle()
+		return
+	}
+	v.helpShown = true
+}
+
+// panelKey returns the key that toggles the i'th panel: 1 to 9, then 0
+// for the tenth. Later panels have no key.
+func panelKey(i int) string {
+	switch {
+	case i < 9:
+		return strconv.Itoa(i + 1)
+	case i == 9:
+		return "0"
+	}
+	return "-"
+}
+
+// updateTitle shows the state of the simulation, the focused pane, the
+// search prompt and the pause state in the border of the outer container.
+func (v *viewKeys) updateTitle() {
+	title := v.title
+	paused, speed := v.ctl.state()
+	if paused {
+		title += "[BLOCKS PAUSED] "
+	}
+	if speed > 0 {
+		title += fmt.Sprintf("[SPEED x%d] ", 1<<speed)
+	} else if speed < 0 {
+		title += fmt.Sprintf("[SPEED /%d] ", 1<<-speed)
+	}
+	if v.visible(v.focus) {
+		title += fmt.Sprintf("[TAB: %s] ", v.panes[v.focus].name)
+	}
+	if v.paused {
+		title += "[PAUSED] "
+	}
+	if v.searching {
+		title += fmt.Sprintf("/%s_ ", string(v.query))
+	} else if v.status != "" {
+		title += fmt.Sprintf("(%s) ", v.status)
+	}
+	_ = v.c.Update(rootID, cr.BorderTitle(title))
+}
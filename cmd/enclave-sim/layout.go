@@ -0,0 +1,356 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/donaldww/idemo2/internal/config"
+	"github.com/mum4k/termdash/cell"
+	cr "github.com/mum4k/termdash/container"
+	"github.com/mum4k/termdash/container/grid"
+	"github.com/mum4k/termdash/linestyle"
+)
+
+// cellSpec is a row or column of the dashboard grid. It holds either a
+// panel or more rows or columns.
+type cellSpec struct {
+	Height int     // percent of the parent, for rows
+	Width  int     // percent of the parent, for columns
+	Cells  int     // fixed height or width in cells, instead of a percent
+	Panel  string  // name of the panel placed here
+	Title  *string // replaces the panel title; "" hides it
+	Color  string  // border color, a name or a 256 color number
+	Border *bool   // draws a border around the panel
+	Rows   []cellSpec
+	Cols   []cellSpec
+}
+
+// layout describes the dashboard as a grid of rows or columns.
+type layout struct {
+	Rows []cellSpec
+	Cols []cellSpec
+}
+
+// defaultLayout is used when there is no layout file. It matches the
+// config/layout.toml shipped with the simulator.
+var defaultLayout = layout{Rows: []cellSpec{
+	{Height: 10, Panel: "gauge"},
+	{Height: 57, Cols: []cellSpec{
+		{Width: 40, Panel: "consensus"},
+		{Width: 60, Rows: []cellSpec{
+			{Height: 20, Panel: "account"},
+			{Cells: orderPanelHeight, Panel: "orders"},
+			{Height: 70, Panel: "blockchain"},
+		}},
+	}},
+	{Height: 20, Cols: []cellSpec{
+		{Width: 25, Panel: "transactions"},
+		{Width: 25, Panel: "interval"},
+		{Width: 25, Panel: "balance"},
+		{Width: 25, Panel: "latency"},
+	}},
+	{Height: 13, Panel: "enclave"},
+}}
+
+// panel is a widget, or a group of widgets, that can be placed in the
+// layout. Its title, border and color are the defaults for the cell.
+type panel struct {
+	title  string
+	border bool
+	color  cell.Color
+	opts   []cr.Option
+}
+
+// panelNames are the panels a layout may use.
+var panelNames = []string{"gauge", "consensus", "account", "orders", "blockchain", "enclave", "peers",
+	"transactions", "interval", "balance", "latency"}
+
+// colorNames are the border colors a layout may name.
+var colorNames = map[string]cell.Color{
+	"default": cell.ColorDefault,
+	"black":   cell.ColorBlack,
+	"red":     cell.ColorRed,
+	"green":   cell.ColorGreen,
+	"yellow":  cell.ColorYellow,
+	"blue":    cell.ColorBlue,
+	"magenta": cell.ColorMagenta,
+	"cyan":    cell.ColorCyan,
+	"white":   cell.ColorWhite,
+}
+
+// loadLayout reads the file named by layoutFile. The default layout is
+// used if the key is empty or the file does not exist.
+func loadLayout(cf *config.Config) (*layout, error) {
+	path := cf.Settings().LayoutFile
+	if path == "" {
+		return &defaultLayout, nil
+	}
+	var l layout
+	if err := config.Decode(path, &l); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &defaultLayout, nil
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := l.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &l, nil
+}
+
+// validate checks that every cell holds one thing, that its size is 1 to
+// 99 percent, with its siblings' at most 100, or a positive number of
+// cells, that panels and colors are known and that no panel is placed
+// twice.
+func (l *layout) validate() error {
+	if len(l.Rows) > 0 && len(l.Cols) > 0 {
+		return errors.New("layout has both rows and cols")
+	}
+	if len(l.Rows) == 0 && len(l.Cols) == 0 {
+		return errors.New("layout has no rows or cols")
+	}
+	seen := map[string]bool{}
+	var check func(where string, specs []cellSpec, rows bool) error
+	check = func(where string, specs []cellSpec, rows bool) error {
+		key, sum := "width", 0
+		if rows {
+			key = "height"
+		}
+		for i, s := range specs {
+			at := fmt.Sprintf("%s[%d]", where, i)
+			switch size := s.size(rows); {
+			case s.Cells < 0:
+				return fmt.Errorf("%s: cells must be positive, not %d", at, s.Cells)
+			case s.Cells > 0:
+			case size < 1 || size > 99:
+				return fmt.Errorf("%s: %s must be 1 to 99 percent, not %d", at, key, size)
+			default:
+				sum += size
+			}
+			n := 0
+			for _, has := range []bool{s.Panel != "", len(s.Rows) > 0, len(s.Cols) > 0} {
+				if has {
+					n++
+				}
+			}
+			if n != 1 {
+				return fmt.Errorf("%s: must hold exactly one of panel, rows or cols", at)
+			}
+			if s.Panel != "" {
+				if !contains(panelNames, s.Panel) {
+					return fmt.Errorf("%s: unknown panel %q, want one of %s", at, s.Panel,
+						strings.Join(panelNames, ", "))
+				}
+				if seen[s.Panel] {
+					return fmt.Errorf("%s: panel %q is placed twice", at, s.Panel)
+				}
+				seen[s.Panel] = true
+			}
+			if s.Color != "" {
+				if _, err := parseColor(s.Color); err != nil {
+					return fmt.Errorf("%s: %w", at, err)
+				}
+			}
+			if err := check(at+".rows", s.Rows, true); err != nil {
+				return err
+			}
+			if err := check(at+".cols", s.Cols, false); err != nil {
+				return err
+			}
+		}
+		if sum > 100 {
+			return fmt.Errorf("%s: the %ss add up to %d percent, more than 100", where, key, sum)
+		}
+		return nil
+	}
+	if err := check("rows", l.Rows, true); err != nil {
+		return err
+	}
+	return check("cols", l.Cols, false)
+}
+
+// has reports whether the panel is placed in the layout.
+func (l *layout) has(name string) bool {
+	var find func(specs []cellSpec) bool
+	find = func(specs []cellSpec) bool {
+		for _, s := range specs {
+			if s.Panel == name || find(s.Rows) || find(s.Cols) {
+				return true
+			}
+		}
+		return false
+	}
+	return find(l.Rows) || find(l.Cols)
+}
+
+// panels returns the panels placed in the layout, in the order they
+// appear in it.
+func (l *layout) panels() []string {
+	var names []string
+	var walk func(specs []cellSpec)
+	walk = func(specs []cellSpec) {
+		for _, s := range specs {
+			if s.Panel != "" {
+				names = append(names, s.Panel)
+			}
+			walk(s.Rows)
+			walk(s.Cols)
+		}
+	}
+	walk(l.Rows)
+	walk(l.Cols)
+	return names
+}
+
+// without returns the layout with the hidden panels removed. The space
+// of a removed cell is shared by its siblings, and a row or column left
+// with a single cell is replaced by that cell.
+func (l *layout) without(hidden map[string]bool) *layout {
+	return &layout{Rows: prune(l.Rows, true, hidden), Cols: prune(l.Cols, false, hidden)}
+}
+
+func prune(specs []cellSpec, rows bool, hidden map[string]bool) []cellSpec {
+	var (
+		kept []cellSpec
+		sum  int
+	)
+	for _, s := range specs {
+		if hidden[s.Panel] {
+			continue
+		}
+		s.Rows, s.Cols = prune(s.Rows, true, hidden), prune(s.Cols, false, hidden)
+		if s.Panel == "" {
+			children := append(append([]cellSpec{}, s.Rows...), s.Cols...)
+			if len(children) == 0 {
+				continue
+			}
+			if len(children) == 1 {
+				only := children[0]
+				only.Height, only.Width, only.Cells = s.Height, s.Width, s.Cells
+				s = only
+			}
+		}
+		kept = append(kept, s)
+		if s.Cells == 0 {
+			sum += s.size(rows)
+		}
+	}
+	// Scale the relative sizes back up to the space they had together.
+	all := 0
+	for _, s := range specs {
+		if s.Cells == 0 {
+			all += s.size(rows)
+		}
+	}
+	for i, s := range kept {
+		if s.Cells > 0 || sum == 0 {
+			continue
+		}
+		n := s.size(rows) * all / sum
+		if n < 1 {
+			n = 1
+		}
+		if n > 99 {
+			n = 99
+		}
+		if rows {
+			kept[i].Height = n
+		} else {
+			kept[i].Width = n
+		}
+	}
+	return kept
+}
+
+// size returns the height of a row or the width of a column.
+func (s cellSpec) size(row bool) int {
+	if row {
+		return s.Height
+	}
+	return s.Width
+}
+
+// build returns the container options that place the panels.
+func (l *layout) build(panels map[string]panel) ([]cr.Option, error) {
+	builder := grid.New()
+	builder.Add(elements(l.Rows, true, panels)...)
+	builder.Add(elements(l.Cols, false, panels)...)
+	return builder.Build()
+}
+
+func elements(specs []cellSpec, rows bool, panels map[string]panel) []grid.Element {
+	var elems []grid.Element
+	for _, s := range specs {
+		var (
+			opts []cr.Option
+			sub  []grid.Element
+		)
+		if s.Panel != "" {
+			opts = s.decorate(panels[s.Panel])
+		}
+		sub = append(sub, elements(s.Rows, true, panels)...)
+		sub = append(sub, elements(s.Cols, false, panels)...)
+		switch {
+		case rows && s.Cells > 0:
+			elems = append(elems, grid.RowHeightFixedWithOpts(s.Cells, opts, sub...))
+		case rows:
+			elems = append(elems, grid.RowHeightPercWithOpts(s.Height, opts, sub...))
+		case s.Cells > 0:
+			elems = append(elems, grid.ColWidthFixedWithOpts(s.Cells, opts, sub...))
+		default:
+			elems = append(elems, grid.ColWidthPercWithOpts(s.Width, opts, sub...))
+		}
+	}
+	return elems
+}
+
+// decorate applies the title, border and color of the cell to p. The
+// container is identified by the panel name.
+func (s cellSpec) decorate(p panel) []cr.Option {
+	title, border, color := p.title, p.border, p.color
+	if s.Title != nil {
+		title = *s.Title
+	}
+	if s.Border != nil {
+		border = *s.Border
+	}
+	if s.Color != "" {
+		color, _ = parseColor(s.Color)
+	}
+	opts := []cr.Option{cr.ID(s.Panel)}
+	if border {
+		opts = append(opts, cr.Border(linestyle.Light), cr.BorderColor(color))
+		if title != "" {
+			opts = append(opts, cr.BorderTitle(" "+strings.TrimSpace(title)+" "))
+		}
+	}
+	return append(opts, p.opts...)
+}
+
+// parseColor returns the color for a name or a 256 color number.
+func parseColor(s string) (cell.Color, error) {
+	if c, ok := colorNames[strings.ToLower(s)]; ok {
+		return c, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 255 {
+		return 0, fmt.Errorf("unknown color %q", s)
+	}
+	return cell.ColorNumber(n), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -4,18 +4,29 @@
 
 // enclave-sim runs a simulation of a blockchain
 // using an enclave to protect the components.
+//
+// Usage:
+//
+//	enclave-sim [-config file] [-set key=value ...]
 package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"github.com/donaldww/idemo2/internal/audit"
 	"github.com/donaldww/idemo2/internal/blockchain"
+	"github.com/donaldww/idemo2/internal/events"
 	"github.com/donaldww/idemo2/internal/logger"
+	"github.com/donaldww/idemo2/internal/response"
+	"github.com/donaldww/idemo2/internal/risk"
+	"github.com/donaldww/idemo2/internal/sgx"
 	"github.com/donaldww/idemo2/internal/tcp"
 	"github.com/donaldww/idemo2/internal/term"
 	"log"
 	"math/rand"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/mum4k/termdash"
@@ -40,20 +51,26 @@ const (
 	playTypeAbsolute
 )
 
-// writeConsensus generates a randomized consensus group every 3 seconds.
-func writeConsensus(ctx context.Context, t *text.Text, trig chan string, waitForGaugeCH chan bool, cf *config.Config) {
-	var (
-		ctr       = 0
-		theLeader = ""
-	)
+// writeConsensus generates a randomized consensus group for every block.
+// The leader is replaced when ctl asks for it.
+func writeConsensus(ctx context.Context, t *text.Text, trig chan blockchain.Proposal, waitForGaugeCH chan int,
+	ctl *control, cf *config.Config) {
+	log := logger.For(logger.Consensus)
+	ctr := 0
 	for {
-		t.Reset()
 		ctr++
-		term.WriteColorf(t, cell.ColorBlue, "\n CONSENSUS GROUP WAITING FOR BLOCK: ")
-		term.WriteColorf(t, cell.ColorRed, "%d\n\n", ctr)
 		select {
+		case <-ctx.Done():
+			return
 		default:
-			nodes := consensus.NewGroup(cf.GetInt("numberOfNodes"))
+		}
+		nodes := consensus.NewGroup(cf.Settings().NumberOfNodes)
+		// drawGroup shows the group and returns its leader.
+		drawGroup := func() string {
+			theLeader := ""
+			t.Reset()
+			term.WriteColorf(t, cell.ColorBlue, "\n CONSENSUS GROUP WAITING FOR BLOCK: ")
+			term.WriteColorf(t, cell.ColorRed, "%d\n\n", ctr)
 			for _, x := range *nodes {
 				format := fmt.Sprintf(" %s\n", x.Node)
 				if x.IsLeader {
@@ -64,44 +81,116 @@ func writeConsensus(ctx context.Context, t *text.Text, trig chan string, waitFor
 					panic(err)
 				}
 			}
-		case <-ctx.Done():
-			return
+			term.WriteColorf(t, cell.ColorBlue, "\n CONSENSUS GROUP LEADER: ")
+			term.WriteColorf(t, cell.ColorRed, "\n %s\n", theLeader)
+			return theLeader
 		}
-		term.WriteColorf(t, cell.ColorBlue, "\n CONSENSUS GROUP LEADER: ")
-		term.WriteColorf(t, cell.ColorRed, "\n %s\n", theLeader)
-		select {
-		case <-waitForGaugeCH:
-			break
+		theLeader := drawGroup()
+		log.Debug("leader selected", "block", ctr, "leader", theLeader)
+		var transactions int
+	WAITING:
+		for {
+			select {
+			case transactions = <-waitForGaugeCH:
+				break WAITING
+			case <-ctl.leader:
+				consensus.ChangeLeader(nodes)
+				theLeader = drawGroup()
+				log.Info("leader changed.", "block", ctr, "leader", theLeader)
+			case <-ctx.Done():
+				return
+			}
 		}
 		term.WriteColorf(t, cell.ColorBlue, "\n VERIFYING BLOCK TRANSACTIONS ")
 		term.WriteColorf(t, cell.ColorRed, "%d ", ctr)
 		term.WriteColorf(t, cell.ColorRed, "-->\n ")
-		for i := 0; i < cf.GetInt("numberOfMoneyBags"); i++ {
+		for i := 0; i < cf.Settings().NumberOfMoneyBags; i++ {
 			term.WriteColorf(t, cell.ColorRed, "💰")
-			time.Sleep(cf.GetMilliseconds("moneyBagsDelay"))
+			time.Sleep(ctl.scale(cf.Settings().MoneyBagsDelay))
 		}
-		trig <- theLeader
+		trig <- blockchain.Proposal{Leader: theLeader, Transactions: transactions}
+	}
+}
+
+// writePeers lists the connected nodes once a second.
+func writePeers(ctx context.Context, t *text.Text, peers *tcp.Peers) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		t.Reset()
+		list := peers.List()
+		if len(list) == 0 {
+			term.WriteColorf(t, cell.ColorBlue, " no nodes connected")
+		}
+		for _, p := range list {
+			term.WriteColorf(t, cell.ColorRed, " %s", p.Remote)
+			term.WriteColorf(t, cell.ColorDefault, "  %s  %d orders\n",
+				time.Since(p.Since).Round(time.Second), p.Orders)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// liveKeys are the config keys applied while enclave-sim runs. The
+// enclave-client keys are read by each client when it starts.
+var liveKeys = []string{
+	"gaugeDelay", "endGaugeWait", "gaugeInterval", "maxTransactions", "randFactor",
+	"loggerDelay", "moneyBagsDelay", "numberOfMoneyBags", "numberOfNodes",
+}
+
+// watchConfig applies changes to the config file while enclave-sim runs,
+// and reports them in the Enclave Monitor.
+func watchConfig(ctx context.Context, cf *config.Config) {
+	log := logger.For(logger.Config)
+	err := cf.Watch(ctx, liveKeys, func(applied, refused, overridden []string, err error) {
+		if err != nil {
+			// A pane shows one line a message.
+			msg := strings.ReplaceAll(err.Error(), "\n", "; ")
+			log.Warn("CONFIG NOT RELOADED: "+msg+"; the config before it is kept.", "err", err)
+			return
+		}
+		for _, k := range refused {
+			log.Warn(fmt.Sprintf("CONFIG: %s cannot change while enclave-sim runs; restart to apply it.", k),
+				"key", k)
+		}
+		for _, k := range overridden {
+			log.Warn(fmt.Sprintf("CONFIG: %s is set by the environment or -set, which override the file.", k),
+				"key", k)
+		}
+		msg := "Config reloaded: nothing applied."
+		if len(applied) > 0 {
+			msg = "Config reloaded: " + strings.Join(applied, ", ") + " applied."
+		}
+		log.Info(msg, "applied", applied, "refused", refused)
+	})
+	if err != nil {
+		log.Error("Config watch failed; changes to the config file are ignored.", "err", err)
 	}
 }
 
 func maxTransactionsAdjust(cf *config.Config) int {
 	s1 := rand.NewSource(time.Now().UnixNano())
 	r1 := rand.New(s1)
-	return r1.Intn(cf.GetInt("randFactor"))
+	return r1.Intn(cf.Settings().RandFactor)
 }
 
 var maxT int
 
 // playGauge continuously changes the displayed percent value on the
-// gauge by the step once every delay. Exits when the context expires.
-func playGauge(ctx context.Context, g *gauge.Gauge, pt playType, waitForGaugeCH chan bool, cf *config.Config) {
+// gauge by the step once every delay. The number of transactions collected
+// is sent on waitForGaugeCH each time the gauge fills. The gauge stands
+// still while ctl has block production paused. Exits when the context
+// expires.
+func playGauge(ctx context.Context, g *gauge.Gauge, pt playType, waitForGaugeCH chan int, ctl *control, cf *config.Config) {
 	prog := 0
-	maxT = cf.GetInt("maxTransactions") - maxTransactionsAdjust(cf)
-	ticker := time.NewTicker(cf.GetMilliseconds("gaugeDelay"))
-	defer ticker.Stop()
-	for {
+	maxT = cf.Settings().MaxTransactions - maxTransactionsAdjust(cf)
+	for ctl.gate(ctx) {
 		select {
-		case <-ticker.C: // The delay.
+		case <-time.After(ctl.scale(cf.Settings().GaugeDelay)): // The delay.
 			switch pt {
 			case playTypePercent:
 				if err := g.Percent(prog); err != nil {
@@ -114,12 +203,13 @@ func playGauge(ctx context.Context, g *gauge.Gauge, pt playType, waitForGaugeCH
 			default:
 				panic("unhandled default case")
 			}
-			prog += cf.GetInt("gaugeInterval")
+			prog += cf.Settings().GaugeInterval
 			if prog > maxT {
 				prog = 0
-				maxT = cf.GetInt("maxTransactions") - maxTransactionsAdjust(cf)
-				waitForGaugeCH <- true
-				time.Sleep(cf.GetMilliseconds("endGaugeWait"))
+				ctl.produced()
+				waitForGaugeCH <- maxT
+				maxT = cf.Settings().MaxTransactions - maxTransactionsAdjust(cf)
+				time.Sleep(ctl.scale(cf.Settings().EndGaugeWait))
 			}
 		case <-ctx.Done():
 			return
@@ -128,13 +218,54 @@ func playGauge(ctx context.Context, g *gauge.Gauge, pt playType, waitForGaugeCH
 }
 
 func main() {
-	cf := config.NewConfig("config")
+	cflags := config.AddFlags(flag.CommandLine)
+	flag.Parse()
+	cf, err := cflags.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
 	// Connect to listening port before writing to the terminal box,
 	// to avoid a `hung` terminal in the case of log.Fatal(err).
-	l, err := net.Listen("tcp", cf.GetString("TCPconnect"))
+	l, err := net.Listen("tcp", cf.Settings().TCPconnect)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Blocks, trades and scans are published for the charts.
+	bus := events.NewBus()
+	chartEvents := bus.Subscribe(100)
+	blockEvents := bus.Subscribe(10)
+	// The signed baseline must verify before the enclave is monitored.
+	enclave := sgx.New(cf.Bin(),
+		sgx.WithDebounce(cf.Settings().SgxDebounce),
+		sgx.WithRescan(cf.Settings().SgxRescan),
+		sgx.WithScanObserver(func(d time.Duration) {
+			bus.Publish(events.Scan, float64(d.Microseconds())/1000)
+		}),
+	)
+	if err := enclave.LoadBaseline(cf.Settings().SgxManifest, cf.Settings().SgxPublicKey); err != nil {
+		log.Fatal(err)
+	}
+	dashboard, err := loadLayout(cf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	responder := response.New(enclave.Root(), response.PolicyFromConfig(cf))
+	auditLog, err := audit.Open(cf.Settings().AuditLog)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer auditLog.Close()
+	// Records are routed to the Enclave Monitor, except for tcp records,
+	// which go to the account pane.
+	var (
+		loggerCH  = make(chan logger.MSG, 10)
+		loggerCH2 = make(chan logger.MSG, 10)
+	)
+	logFile, err := logger.Setup(cf, map[string]chan logger.MSG{"": loggerCH, logger.TCP: loggerCH2})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer logFile.Close()
 	// termbox.New returns a 'termbox' based on
 	// the user's default terminal: (e.g. Terminal or iTerm on macOS)
 	t, err := termbox.New(termbox.ColorMode(terminalapi.ColorMode256))
@@ -148,7 +279,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	balanceLogger, err := text.New()
+	balanceLogger, err := text.New(text.RollContent())
 	if err != nil {
 		panic(err)
 	}
@@ -161,14 +292,12 @@ func main() {
 	transactionGauge, err := gauge.New(
 		gauge.Height(1),
 		gauge.Color(cell.ColorBlue),
-		gauge.Border(linestyle.Light),
-		gauge.BorderTitle(" Collecting Trades "),
 	)
 	if err != nil {
 		panic(err)
 	}
-	// Pre-Consensus Transaction Monitor
-	blockWriteWindow, err := text.New(text.WrapAtWords(), text.RollContent())
+	// Blockchain Tail Monitor
+	insp, err := newInspector()
 	if err != nil {
 		panic(err)
 	}
@@ -177,98 +306,118 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	title := fmt.Sprintf(" ENCLAVE SIMULATER %s - PRESS Q TO QUIT ", version)
+	// Connected Nodes Window
+	peersWindow, err := text.New()
+	if err != nil {
+		panic(err)
+	}
+	// The account is traded by connected nodes and from the order panel.
+	rules := risk.New(risk.LimitsFromConfig(cf), logger.For(logger.TCP))
+	if path := cf.Settings().PolicyFile; path != "" {
+		go rules.WatchPolicy(ctx, path)
+	}
+	exchange := tcp.NewExchange(balanceWindow, responder, rules, auditLog, bus, cf)
+	orders, err := newOrderPanel(exchange)
+	if err != nil {
+		panic(err)
+	}
+	peers := tcp.NewPeers()
+	// Charts of the simulation events.
+	chart, err := newCharts(cf.Settings().ChartWindow)
+	if err != nil {
+		panic(err)
+	}
+	panels := map[string]panel{
+		"gauge":     {title: "Collecting Trades", border: true, opts: []cr.Option{cr.PlaceWidget(transactionGauge)}},
+		"consensus": {title: "Consensus Group Randomizer", border: true, opts: []cr.Option{cr.PlaceWidget(consensusWindow)}},
+		"account": {title: "Account: " + cf.Settings().AccountID, border: true, color: cell.ColorCyan,
+			opts: []cr.Option{cr.SplitHorizontal(
+				cr.Top(cr.PlaceWidget(balanceWindow)),
+				cr.Bottom(cr.PlaceWidget(balanceLogger)),
+				cr.SplitPercent(cf.Settings().InputBlock),
+			)}},
+		"orders":       {title: "Order Entry", border: true, color: cell.ColorCyan, opts: orders.opts},
+		"blockchain":   {title: "Blockchain Tail Monitor", border: true, opts: []cr.Option{cr.PlaceWidget(insp.list)}},
+		"enclave":      {title: "Enclave Monitor", border: true, opts: []cr.Option{cr.PlaceWidget(softwareMonitorWindow)}},
+		"peers":        {title: "Connected Nodes", border: true, opts: []cr.Option{cr.PlaceWidget(peersWindow)}},
+		"transactions": {title: "Transactions per Block", border: true, opts: []cr.Option{cr.PlaceWidget(chart.txs)}},
+		"interval":     {title: "Block Interval", border: true, opts: []cr.Option{cr.PlaceWidget(chart.interval)}},
+		"balance":      {title: "Account Balance", border: true, opts: []cr.Option{cr.PlaceWidget(chart.balance)}},
+		"latency":      {title: "Enclave Scan Latency", border: true, opts: []cr.Option{cr.PlaceWidget(chart.latency)}},
+	}
+	// Key bindings, shown in place of the panels.
+	helpWindow, err := text.New(text.WrapAtWords())
+	if err != nil {
+		panic(err)
+	}
+	title := fmt.Sprintf(" ENCLAVE SIMULATER %s - PRESS ? FOR HELP, Q TO QUIT ", version)
 	// Container Layout.
-	c := container(err, t, title, transactionGauge, consensusWindow, cf, balanceWindow,
-		balanceLogger, blockWriteWindow, softwareMonitorWindow)
+	c := container(t, title, dashboard, panels)
 	// GOROUTINES
+	ctl := newControl()
 	var (
-		loggerCH       = make(chan logger.MSG, 10)
-		loggerCH2      = make(chan logger.MSG, 10)
-		blockCH        = make(chan string)
-		waitForGaugeCH = make(chan bool)
+		blockCH        = make(chan blockchain.Proposal)
+		waitForGaugeCH = make(chan int)
 	)
 	// Display randomly generated nodes in the 'consensusWindow'.
-	go writeConsensus(ctx, consensusWindow, blockCH, waitForGaugeCH, cf)
+	go writeConsensus(ctx, consensusWindow, blockCH, waitForGaugeCH, ctl, cf)
 	// Play the transaction gathering gauge.
-	go playGauge(ctx, transactionGauge, playTypeAbsolute, waitForGaugeCH, cf)
-	go logger.WriteLogger(ctx, softwareMonitorWindow, loggerCH, cf)
-	go logger.ScanEnclave(loggerCH, cf)
-	go logger.WriteLogger(ctx, balanceLogger, loggerCH2, cf)
-	go blockchain.HandleBlockchain(blockWriteWindow, blockCH, maxT)
-	go tcp.Server(l, balanceLogger, balanceWindow, loggerCH2, cf)
-	// Define the exit handler.
-	quitter := func(k *terminalapi.Keyboard) {
-		if k.Key == 'q' || k.Key == 'Q' {
-			cancel() // generated by contextWithCancel()
-		}
+	go playGauge(ctx, transactionGauge, playTypeAbsolute, waitForGaugeCH, ctl, cf)
+	// Each log pane keeps paneHistory lines for scrolling and searching.
+	var (
+		enclavePane = term.NewPane(softwareMonitorWindow, cf.Settings().PaneHistory)
+		accountPane = term.NewPane(balanceLogger, cf.Settings().PaneHistory)
+	)
+	go logger.WriteLogger(ctx, enclavePane, loggerCH)
+	go logger.ScanEnclave(ctx, enclave, responder, auditLog, cf)
+	go logger.WriteLogger(ctx, accountPane, loggerCH2)
+	go blockchain.HandleBlockchain(blockCH, responder, bus)
+	go insp.run(ctx, blockEvents)
+	go chart.run(ctx, chartEvents)
+	go tcp.Server(l, exchange, peers, auditLog, cf.Settings().TCPidleTimeout)
+	go writePeers(ctx, peersWindow, peers)
+	go watchConfig(ctx, cf)
+	// Define the keyboard handler, which also exits the program.
+	keys := &viewKeys{
+		c:       c,
+		title:   title,
+		layout:  dashboard,
+		panels:  panels,
+		hidden:  map[string]bool{},
+		help:    helpWindow,
+		ctl:     ctl,
+		enclave: enclave,
+		blocks:  insp,
+		panes: []namedPane{
+			{"enclave", "Enclave Monitor", enclavePane},
+			{"account", "Account", accountPane},
+		},
+		quit: cancel, // generated by contextWithCancel()
+	}
+	if !keys.visible(0) {
+		keys.nextPane()
 	}
+	keys.updateTitle()
 	// Run the program.
-	if thisErr := termdash.Run(ctx, t, c, termdash.KeyboardSubscriber(quitter)); thisErr != nil {
+	if thisErr := termdash.Run(ctx, t, c, termdash.KeyboardSubscriber(keys.handle)); thisErr != nil {
 		panic(thisErr)
 	}
 }
 
-func container(err error, t *termbox.Terminal, title string, transactionGauge *gauge.Gauge,
-	consensusWindow *text.Text, cf *config.Config, balanceWindow *text.Text,
-	balanceLogger *text.Text, blockWriteWindow *text.Text, softwareMonitorWindow *text.Text) *cr.Container {
-	c, err := cr.New(t,
+// container places the panels in the outer container as the layout
+// describes.
+func container(t *termbox.Terminal, title string, l *layout, panels map[string]panel) *cr.Container {
+	opts, err := l.build(panels)
+	if err != nil {
+		panic(err)
+	}
+	c, err := cr.New(t, append([]cr.Option{
+		cr.ID(rootID),
 		cr.Border(linestyle.Light),
 		cr.BorderColor(cell.ColorDefault),
 		cr.BorderTitleAlignCenter(),
 		cr.BorderTitle(title),
-		cr.SplitHorizontal(
-			cr.Top(
-				cr.PlaceWidget(transactionGauge),
-			),
-			cr.Bottom(
-				cr.SplitHorizontal(
-					cr.Top(
-						cr.SplitVertical(
-							cr.Left(
-								cr.Border(linestyle.Light),
-								cr.BorderTitle(" Consensus Group Randomizer "),
-								cr.PlaceWidget(consensusWindow),
-							),
-							cr.Right(
-								cr.SplitHorizontal(
-									cr.Top(
-										cr.Border(linestyle.Light),
-										cr.BorderColor(cell.ColorCyan),
-										cr.BorderTitle(
-											" Account: "+cf.GetString("accountID")+" "),
-										cr.SplitHorizontal(
-											cr.Top(
-												cr.PlaceWidget(balanceWindow),
-											),
-											cr.Bottom(
-												cr.PlaceWidget(balanceLogger),
-											),
-											cr.SplitPercent(cf.GetInt("inputBlock")), // the input field
-										),
-									),
-									cr.Bottom(
-										cr.Border(linestyle.Light),
-										cr.BorderTitle(" Blockchain Tail Monitor "),
-										cr.PlaceWidget(blockWriteWindow),
-									),
-									cr.SplitPercent(cf.GetInt("inputButtons")),
-								),
-							),
-							cr.SplitPercent(40),
-						),
-					),
-					cr.Bottom(
-						cr.Border(linestyle.Light),
-						cr.BorderTitle(" Enclave Monitor "),
-						cr.PlaceWidget(softwareMonitorWindow),
-					),
-					cr.SplitPercent(cf.GetInt("consensusSGXmonitor")),
-				),
-			),
-			cr.SplitPercent(cf.GetInt("gaugeConsensus")),
-		),
-	)
+	}, opts...)...)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,123 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"unicode"
+
+	"github.com/donaldww/idemo2/internal/tcp"
+	"github.com/donaldww/idemo2/internal/term"
+	"github.com/mum4k/termdash/align"
+	"github.com/mum4k/termdash/cell"
+	cr "github.com/mum4k/termdash/container"
+	"github.com/mum4k/termdash/widgets/button"
+	"github.com/mum4k/termdash/widgets/text"
+	"github.com/mum4k/termdash/widgets/textinput"
+)
+
+// orderPanelHeight is the height of the order entry panel in cells,
+// including its border.
+const orderPanelHeight = 5
+
+// orderPanel lets the user trade from the dashboard. Its orders go
+// through the same Exchange as the orders of connected nodes.
+type orderPanel struct {
+	ex     *tcp.Exchange
+	amount *textinput.TextInput
+	result *text.Text
+	opts   []cr.Option
+}
+
+// newOrderPanel builds the amount field, the Buy, Sell and Reload buttons
+// and the result line.
+func newOrderPanel(ex *tcp.Exchange) (*orderPanel, error) {
+	o := &orderPanel{ex: ex}
+	var err error
+	// While the field has focus, digits and the decimal point are not
+	// seen by the view keys.
+	o.amount, err = textinput.New(
+		textinput.Label(" Amount: ", cell.FgColor(cell.ColorCyan)),
+		textinput.MaxWidthCells(20),
+		textinput.Filter(func(r rune) bool { return unicode.IsDigit(r) || r == '.' }),
+		textinput.ExclusiveKeyboardOnFocus(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	o.result, err = text.New()
+	if err != nil {
+		return nil, err
+	}
+	newButton := func(label string, color cell.Color, fn func() error) (*button.Button, error) {
+		return button.New(label, fn,
+			button.Height(1),
+			button.WidthFor("Reload"),
+			button.DisableShadow(),
+			button.FillColor(color),
+		)
+	}
+	buyB, err := newButton("Buy", cell.ColorNumber(28), func() error { return o.trade("buy") })
+	if err != nil {
+		return nil, err
+	}
+	sellB, err := newButton("Sell", cell.ColorNumber(124), func() error { return o.trade("sell") })
+	if err != nil {
+		return nil, err
+	}
+	reloadB, err := newButton("Reload", cell.ColorNumber(220), func() error { return o.submit("reload") })
+	if err != nil {
+		return nil, err
+	}
+	center := cr.AlignHorizontal(align.HorizontalCenter)
+	o.opts = []cr.Option{
+		cr.SplitHorizontal(
+			cr.Top(
+				cr.PlaceWidget(o.amount),
+			),
+			cr.Bottom(
+				cr.SplitHorizontal(
+					cr.Top(
+						cr.SplitVertical(
+							cr.Left(cr.PlaceWidget(buyB), center),
+							cr.Right(
+								cr.SplitVertical(
+									cr.Left(cr.PlaceWidget(sellB), center),
+									cr.Right(cr.PlaceWidget(reloadB), center),
+								),
+							),
+							cr.SplitPercent(33),
+						),
+					),
+					cr.Bottom(
+						cr.PlaceWidget(o.result),
+					),
+					cr.SplitFixed(1),
+				),
+			),
+			cr.SplitFixed(1),
+		),
+	}
+	return o, nil
+}
+
+// trade submits a buy or sell order for the amount in the field.
+func (o *orderPanel) trade(side string) error {
+	amt := o.amount.ReadAndClear()
+	if amt == "" {
+		return o.show("enter an amount first.")
+	}
+	return o.submit(side + " " + amt)
+}
+
+// submit executes the order line and shows the reply.
+func (o *orderPanel) submit(line string) error {
+	return o.show(o.ex.Execute(line))
+}
+
+func (o *orderPanel) show(reply string) error {
+	o.result.Reset()
+	term.WriteColorf(o.result, cell.ColorYellow, " %s", reply)
+	return nil
+}
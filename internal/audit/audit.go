@@ -0,0 +1,182 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+// Package audit keeps a tamper-evident, append-only record of trades and
+// enclave events. Each record carries the hash of the one before it, so
+// altering or deleting any entry breaks the chain from that point on.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record kinds.
+const (
+	Trade      = "trade"
+	Reload     = "reload"
+	Transfer   = "transfer"
+	Connection = "connection"
+	Enclave    = "enclave"
+)
+
+// genesis is the previous hash of the first record in a log.
+const genesis = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Record is one entry in the audit log.
+type Record struct {
+	Seq    int64             `json:"seq"`
+	Time   string            `json:"time"`
+	Kind   string            `json:"kind"`
+	Msg    string            `json:"msg"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Prev   string            `json:"prev"`
+	Hash   string            `json:"hash"`
+}
+
+// sum returns the hash of the record, computed over every field but Hash.
+// encoding/json sorts map keys, so the encoding is stable.
+func (r Record) sum() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// Log appends records to an audit log file. A nil *Log discards records,
+// so auditing can be switched off without checks at every call site.
+type Log struct {
+	mu   sync.Mutex
+	f    *os.File
+	seq  int64
+	prev string
+}
+
+// Open opens the audit log at path, creating it if necessary. The existing
+// chain is verified first so that new records never extend a broken one.
+func Open(path string) (*Log, error) {
+	last, err := verify(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{f: f, prev: genesis}
+	if last != nil {
+		l.seq, l.prev = last.Seq, last.Hash
+	}
+	return l, nil
+}
+
+// Append adds a record to the log and syncs it to disk.
+func (l *Log) Append(kind, msg string, fields map[string]string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := Record{
+		Seq:    l.seq + 1,
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Kind:   kind,
+		Msg:    msg,
+		Fields: fields,
+		Prev:   l.prev,
+	}
+	var err error
+	if r.Hash, err = r.sum(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.seq, l.prev = r.Seq, r.Hash
+	return nil
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// ChainError reports where an audit log stops verifying.
+type ChainError struct {
+	Line int
+	What string
+}
+
+func (e ChainError) Error() string {
+	return fmt.Sprintf("audit: line %d: %s", e.Line, e.What)
+}
+
+// Verify checks every record in the log at path and returns the number of
+// records found. Altered records fail their hash, and deleted or reordered
+// records break the sequence numbers and the chain of previous hashes.
+// Truncation of the newest records can only be detected by comparing the
+// returned count, or the last hash, with a copy kept elsewhere.
+func Verify(path string) (int64, error) {
+	last, err := verify(path)
+	if last == nil {
+		return 0, err
+	}
+	return last.Seq, err
+}
+
+// verify returns the last record that verified, and an error describing
+// the first one that did not.
+func verify(path string) (*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var last *Record
+	prev, seq := genesis, int64(0)
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; s.Scan(); line++ {
+		var r Record
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			return last, ChainError{line, "unreadable record: " + err.Error()}
+		}
+		if r.Seq != seq+1 {
+			return last, ChainError{line, fmt.Sprintf("sequence %d follows %d: records missing", r.Seq, seq)}
+		}
+		if r.Prev != prev {
+			return last, ChainError{line, fmt.Sprintf("record %d does not follow the previous hash", r.Seq)}
+		}
+		sum, err := r.sum()
+		if err != nil {
+			return last, err
+		}
+		if sum != r.Hash {
+			return last, ChainError{line, fmt.Sprintf("record %d has been altered", r.Seq)}
+		}
+		prev, seq = r.Hash, r.Seq
+		rec := r
+		last = &rec
+	}
+	return last, s.Err()
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLog writes a log of n trade records and returns its path and
+// lines.
+func writeLog(t *testing.T, n int) (string, [][]byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := l.Append(Trade, "bought", map[string]string{"amount": "10.00"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, bytes.SplitAfter(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+}
+
+// edit returns line with the record changed by fn and its hash left alone.
+func edit(t *testing.T, line []byte, fn func(*Record)) []byte {
+	t.Helper()
+	var r Record
+	if err := json.Unmarshal(line, &r); err != nil {
+		t.Fatal(err)
+	}
+	fn(&r)
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(data, '\n')
+}
+
+func TestVerify(t *testing.T) {
+	path, _ := writeLog(t, 3)
+	n, err := Verify(path)
+	if err != nil || n != 3 {
+		t.Fatalf("Verify = %d, %v; want 3, nil", n, err)
+	}
+	// Open continues the chain.
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(Reload, "reloaded", nil); err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Close()
+	if n, err := Verify(path); err != nil || n != 4 {
+		t.Errorf("Verify after reopening = %d, %v; want 4, nil", n, err)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		tamper func(t *testing.T, lines [][]byte) [][]byte
+		// Records verified before the bad line, and the error.
+		n    int64
+		line int
+		what string
+	}{
+		{"altered message", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[1] = edit(t, lines[1], func(r *Record) { r.Msg = "sold" })
+			return lines
+		}, 1, 2, "record 2 has been altered"},
+		{"altered field", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[2] = edit(t, lines[2], func(r *Record) { r.Fields["amount"] = "99.00" })
+			return lines
+		}, 2, 3, "record 3 has been altered"},
+		{"rehashed record", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[0] = edit(t, lines[0], func(r *Record) {
+				r.Msg = "sold"
+				r.Hash, _ = r.sum()
+			})
+			return lines
+		}, 1, 2, "record 2 does not follow the previous hash"},
+		{"deleted record", func(t *testing.T, lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}, 1, 2, "sequence 3 follows 1: records missing"},
+		{"reordered records", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 1, 2, "sequence 3 follows 1: records missing"},
+		{"garbled line", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[3] = []byte("{\"seq\":\n")
+			return lines
+		}, 3, 4, "unreadable record"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, lines := writeLog(t, 4)
+			if err := os.WriteFile(path, bytes.Join(tt.tamper(t, lines), nil), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			n, err := Verify(path)
+			var ce ChainError
+			if !errors.As(err, &ce) {
+				t.Fatalf("Verify error = %v, want a ChainError", err)
+			}
+			if n != tt.n || ce.Line != tt.line || !strings.HasPrefix(ce.What, tt.what) {
+				t.Errorf("Verify = %d, %v; want %d, line %d: %s", n, err, tt.n, tt.line, tt.what)
+			}
+			if _, err := Open(path); err == nil {
+				t.Error("Open extended a broken chain")
+			}
+		})
+	}
+}
+
+func TestVerifyTruncation(t *testing.T) {
+	// Dropping the newest records leaves a valid chain; only the count
+	// tells.
+	path, lines := writeLog(t, 3)
+	if err := os.WriteFile(path, bytes.Join(lines[:2], nil), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Verify(path); err != nil || n != 2 {
+		t.Errorf("Verify = %d, %v; want 2, nil", n, err)
+	}
+}
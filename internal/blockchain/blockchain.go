@@ -5,14 +5,20 @@
 package blockchain
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-
-	"github.com/donaldww/idemo2/internal/term"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/mum4k/termdash/cell"
-	"github.com/mum4k/termdash/widgets/text"
+	"github.com/donaldww/idemo2/internal/events"
+	"github.com/donaldww/idemo2/internal/logger"
+	"github.com/donaldww/idemo2/internal/money"
+	"github.com/donaldww/idemo2/internal/response"
+
 	"github.com/nu7hatch/gouuid"
 )
 
@@ -25,67 +31,181 @@ type Block struct {
 	NumberOfTransactions int
 	Nonce                int
 	PrevHash             string
+	Signature            string
+	Transactions         []Transaction // orders executed since the block before
+}
+
+// Transaction is an order executed by the exchange. It is recorded in the
+// next block added to the chain.
+type Transaction struct {
+	ID      string
+	Time    string
+	Account string
+	Kind    string       // buy, sell, reload or transfer
+	Legs    []Leg        // change of the holdings, by asset
+	Price   money.Amount // in the quote asset, of a trade with two legs
+	To      string       // account credited by a transfer
+	Memo    string
+}
+
+// Leg is the change of the holding of one asset in a transaction.
+type Leg struct {
+	Asset  string
+	Amount money.Amount
+}
+
+// String formats the leg as a signed amount, such as "+10.00 IC".
+func (l Leg) String() string {
+	sign := ""
+	if l.Amount >= 0 {
+		sign = "+"
+	}
+	return fmt.Sprintf("%s%s %s", sign, l.Amount, l.Asset)
+}
+
+// String formats the transaction on one line: its ID, kind, legs and
+// price, the account, and the account credited and memo of a transfer.
+func (tx Transaction) String() string {
+	parts := []string{tx.ID, tx.Kind}
+	for _, l := range tx.Legs {
+		parts = append(parts, l.String())
+	}
+	if tx.Price > 0 {
+		parts = append(parts, "@"+tx.Price.String())
+	}
+	parts = append(parts, "by", tx.Account)
+	if tx.To != "" {
+		parts = append(parts, "to", tx.To)
+	}
+	if tx.Memo != "" {
+		parts = append(parts, fmt.Sprintf("%q", tx.Memo))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Proposal asks for a block holding the given number of transactions,
+// led by the consensus group leader.
+type Proposal struct {
+	Leader       string
+	Transactions int
+}
+
+// Check is the result of one validation rule applied to a block.
+type Check struct {
+	Rule string
+	OK   bool
 }
 
 // Blockchain is a series of validated Blocks
-var bc []Block
-var tWindow *text.Text
-var flag = false
-var leader string
-
-// A counter.
-var __ci int
-var count = func() int {
-	__ci++
-	return __ci
-}
-
-// bDump logs messages into the SGX monitor widget.
-func bDump(b []Block) {
-	i := count() - 1
-	if i%9 == 0 {
-		tWindow.Reset()
-	}
-	var color cell.Color
-	if flag {
-		color = cell.ColorMagenta
-	} else {
-		color = cell.ColorDefault
-	}
-	term.WriteColorf(tWindow, cell.ColorRed, " 💰")
-	term.WriteColorf(tWindow, color, " %#v\n", b[i])
-	flag = !flag
-}
-
-// HandleBlockchain is the main point of for the blockchain window.
-func HandleBlockchain(t *text.Text, trig chan string, maxT int) {
-	// tWindow is global, the program will crash if removed!
-	tWindow = t
+var (
+	mu      sync.RWMutex
+	bc      []Block
+	pending []Transaction  // waiting for the next block
+	heights map[string]int // height of the block recording each transaction
+)
+
+// The consensus group signs every block with this key.
+var signer ed25519.PrivateKey
+
+func init() {
+	var err error
+	_, signer, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Signer returns the public key that verifies block signatures.
+func Signer() ed25519.PublicKey {
+	return signer.Public().(ed25519.PublicKey)
+}
+
+// Blocks returns a copy of the chain, genesis block first.
+func Blocks() []Block {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]Block(nil), bc...)
+}
+
+// Submit queues the transaction for the next block.
+func Submit(tx Transaction) {
+	mu.Lock()
+	defer mu.Unlock()
+	pending = append(pending, tx)
+}
+
+// Height returns the height of the block that recorded the transaction
+// with the given ID. It reports false while the transaction is pending.
+func Height(id string) (int, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	h, ok := heights[id]
+	return h, ok
+}
+
+// Validate applies the validation rules to the block at height i.
+func Validate(i int) []Check {
+	mu.RLock()
+	defer mu.RUnlock()
+	b := bc[i]
+	checks := []Check{
+		{"hash matches contents", calculateHash(b) == b.Hash},
+		{"signed by the consensus group", verify(b)},
+	}
+	if i > 0 {
+		checks = append(checks,
+			Check{"height follows previous block", bc[i-1].Nonce+1 == b.Nonce},
+			Check{"links to previous block", bc[i-1].Hash == b.PrevHash},
+		)
+	}
+	return checks
+}
+
+// HandleBlockchain adds a block to the chain for every proposal received
+// on trig, starting with the genesis block. No blocks are produced while
+// r reports that block production is halted. Every block added to the
+// chain is published on bus.
+func HandleBlockchain(trig chan Proposal, r *response.Responder, bus *events.Bus) {
 	// Create genesis block.
-	genesisBlock := Block{Nonce: 0, Timestamp: time.Now().String(),
-		Data: "", NumberOfTransactions: 0, Hash: "", PrevHash: "",
+	genesisBlock := Block{Nonce: 0, Timestamp: time.Now().Format(time.RFC3339Nano),
+		Data: "", NumberOfTransactions: 0, PrevHash: "",
 		ConsensusLeader: "GENESIS BLOCK"}
+	genesisBlock.Hash = calculateHash(genesisBlock)
+	sign(&genesisBlock)
+	mu.Lock()
 	bc = append(bc, genesisBlock)
-	// Dump genesis block.
-	bDump(bc)
+	mu.Unlock()
 	for {
-		leader = <-trig
-		if leader != "" {
-			go handleBlocks(maxT)
+		p := <-trig
+		if r.BlocksHalted() {
+			logger.For(logger.Blockchain).Warn("block refused: enclave tampered", "leader", p.Leader)
+			continue
+		}
+		if p.Leader != "" {
+			go handleBlocks(p, bus)
 		}
 	}
 }
 
-func handleBlocks(trans int) {
-	newBlock, err := generateBlock(bc[len(bc)-1], trans)
+func handleBlocks(p Proposal, bus *events.Bus) {
+	mu.Lock()
+	defer mu.Unlock()
+	newBlock, err := generateBlock(bc[len(bc)-1], p)
 	if err != nil {
 		panic(err)
 	}
 	if isBlockValid(newBlock, bc[len(bc)-1]) {
 		newBlockchain := append(bc, newBlock)
 		replaceChain(newBlockchain)
+		if heights == nil {
+			heights = map[string]int{}
+		}
+		for _, tx := range newBlock.Transactions {
+			heights[tx.ID] = newBlock.Nonce
+		}
+		pending = pending[len(newBlock.Transactions):]
+		bus.Publish(events.Block, float64(len(newBlock.Transactions)))
 	}
-	bDump(bc)
 }
 
 // make sure block is valid by checking index, and comparing the hash of the previous block
@@ -99,7 +219,7 @@ func isBlockValid(newBlock, oldBlock Block) bool {
 	if calculateHash(newBlock) != newBlock.Hash {
 		return false
 	}
-	return true
+	return verify(newBlock)
 }
 
 // make sure the chain we're checking is longer than the current bc
@@ -112,26 +232,46 @@ func replaceChain(newBlocks []Block) {
 // SHA256 hashing
 func calculateHash(block Block) string {
 	record := string(rune(block.Nonce)) + block.Timestamp + string(rune(block.NumberOfTransactions)) + block.PrevHash
+	for _, tx := range block.Transactions {
+		record += fmt.Sprintf("%s %s %s %s", tx.ID, tx.Time, tx.Account, tx.Kind)
+		for _, l := range tx.Legs {
+			record += fmt.Sprintf(" %s %s", l.Amount, l.Asset)
+		}
+		record += fmt.Sprintf(" @%s %s %q;", tx.Price, tx.To, tx.Memo)
+	}
 	h := sha256.New()
 	h.Write([]byte(record))
 	hashed := h.Sum(nil)
 	return hex.EncodeToString(hashed)
 }
 
+// sign signs the hash of the block.
+func sign(block *Block) {
+	block.Signature = hex.EncodeToString(ed25519.Sign(signer, []byte(block.Hash)))
+}
+
+// verify checks the signature of the block.
+func verify(block Block) bool {
+	sig, err := hex.DecodeString(block.Signature)
+	return err == nil && ed25519.Verify(Signer(), []byte(block.Hash), sig)
+}
+
 // create a new block using previous block's hash
-func generateBlock(oldBlock Block, amount int) (Block, error) {
+func generateBlock(oldBlock Block, p Proposal) (Block, error) {
 	var newBlock Block
 	t := time.Now()
-	u3, err := uuid.NewV3(uuid.NamespaceURL, []byte(leader))
+	u3, err := uuid.NewV3(uuid.NamespaceURL, []byte(p.Leader))
 	if err != nil {
 		panic(err)
 	}
 	newBlock.Nonce = oldBlock.Nonce + 1
-	newBlock.Timestamp = t.String()
-	newBlock.ConsensusLeader = leader
+	newBlock.Timestamp = t.Format(time.RFC3339Nano)
+	newBlock.ConsensusLeader = p.Leader
 	newBlock.Data = u3.String()
-	newBlock.NumberOfTransactions = amount
+	newBlock.NumberOfTransactions = p.Transactions
+	newBlock.Transactions = append([]Transaction(nil), pending...)
 	newBlock.PrevHash = oldBlock.Hash
 	newBlock.Hash = calculateHash(newBlock)
+	sign(&newBlock)
 	return newBlock, nil
 }
@@ -1,67 +1,187 @@
 package config
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/donaldww/idemo2/internal/filewatch"
+	"github.com/donaldww/idemo2/internal/money"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
 var (
-	once sync.Once
-	conf *Config
+	once    sync.Once
+	conf    *Config
+	loadErr error
+	// mu guards viper and the settings, which Watch updates while they
+	// are read.
+	mu sync.RWMutex
+	// pinned are the keys, in lower case, set by the environment or the
+	// command line; Watch leaves them alone.
+	pinned = map[string]bool{}
 )
 
+// EnvPrefix starts the names of the environment variables that override
+// the keys of the config file: ENCLAVE_NUMBEROFNODES sets numberOfNodes.
+const EnvPrefix = "ENCLAVE"
+
 type Config struct {
-	home string
+	home     string
+	settings Settings
 }
 
-// NewConfig initializes and returns a new Config instance.
+// NewConfig initializes and returns a new Config instance, from the
+// config file filename in ~/.config/enclave and the environment. It exits
+// the program when the settings are not valid.
 func NewConfig(filename string) *Config {
+	c, err := load("", filename, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return c
+}
+
+// Load returns the Config of the config file at path, or of
+// ~/.config/enclave/config.toml when path is "". Keys missing from the
+// file take their defaults. The environment variables EnvPrefix_<KEY>
+// override the file, and the key=value pairs of set override both. Load
+// sets the precision of money amounts. The error names the keys whose
+// values are not valid.
+func Load(path string, set []string) (*Config, error) {
+	return load(path, "config", set)
+}
+
+func load(path, filename string, set []string) (*Config, error) {
 	once.Do(func() {
-		home := getHome()
-		viper.SetConfigName(filename)
-		viper.AddConfigPath(home)
-		err := viper.ReadInConfig()
-		if err != nil {
-			panic(fmt.Errorf("fatal error config file: %s", err))
-		}
-		conf = &Config{home: home}
+		conf, loadErr = read(path, filename, set)
 	})
-	return conf
+	return conf, loadErr
 }
 
-// GetInt returns an int from the config file.
-func (c *Config) GetInt(key string) int {
-	return viper.GetInt(key)
+func read(path, filename string, set []string) (*Config, error) {
+	home := getHome()
+	if path != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		// Relative paths in the file are under its directory.
+		home = filepath.Dir(abs)
+		viper.SetConfigFile(abs)
+	} else {
+		viper.SetConfigName(filename)
+		viper.AddConfigPath(home)
+	}
+	for k, v := range defaults {
+		viper.SetDefault(k, v)
+	}
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.AutomaticEnv()
+	if err := viper.ReadInConfig(); err != nil {
+		// Without a file of its own, a program runs on the defaults.
+		var missing viper.ConfigFileNotFoundError
+		if path != "" || !errors.As(err, &missing) {
+			return nil, fmt.Errorf("config file: %w", err)
+		}
+	}
+	for k := range defaults {
+		if _, ok := os.LookupEnv(EnvPrefix + "_" + strings.ToUpper(k)); ok {
+			pinned[strings.ToLower(k)] = true
+		}
+	}
+	for _, kv := range set {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || keyOf(k) == "" {
+			return nil, fmt.Errorf("-set %s: want key=value with a key of the config file", kv)
+		}
+		viper.Set(k, v)
+		pinned[strings.ToLower(k)] = true
+	}
+	c := &Config{home: home}
+	s, err := c.decode()
+	if err != nil {
+		return nil, err
+	}
+	c.settings = s
+	return c, nil
 }
 
-// GetString returns a string from the config file.
-func (c *Config) GetString(key string) string {
-	return viper.GetString(key)
+// Flags are the -config and -set flags of a program.
+type Flags struct {
+	Path string
+	Set  []string
 }
 
-// GetBool returns a bool from the config file.
-func (c *Config) GetBool(key string) bool {
-	return viper.GetBool(key)
+// AddFlags defines -config and -set on fs.
+func AddFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{}
+	fs.StringVar(&f.Path, "config", "", "config file (default ~/.config/enclave/config.toml)")
+	fs.Func("set", "override a key of the config file, as key=value; may be repeated", func(kv string) error {
+		f.Set = append(f.Set, kv)
+		return nil
+	})
+	return f
 }
 
-// GetFloat64 returns a float64 from the config file.
-func (c *Config) GetFloat64(key string) float64 {
-	return viper.GetFloat64(key)
+// Load returns the Config selected by the flags.
+func (f *Flags) Load() (*Config, error) {
+	return Load(f.Path, f.Set)
 }
 
-// GetMilliseconds returns a Duration in milliseconds.
-func (c *Config) GetMilliseconds(key string) time.Duration {
-	return time.Duration(viper.GetInt(key)) * time.Millisecond
+// Settings returns the settings in effect. Watch replaces them when the
+// file changes, so a program reads them again each time it needs the
+// value of a live key.
+func (c *Config) Settings() Settings {
+	mu.RLock()
+	defer mu.RUnlock()
+	return c.settings
 }
 
-// GetSeconds returns a Duration in seconds.
-func (c *Config) GetSeconds(key string) time.Duration {
-	return time.Duration(viper.GetInt(key)) * time.Second
+// decode returns the settings of viper, or the error naming the keys
+// whose values are not valid. mu must be held.
+func (c *Config) decode() (Settings, error) {
+	var s Settings
+	// Amounts are parsed with the precision, so it is decoded first.
+	var p int
+	if err := viper.UnmarshalKey("precision", &p); err != nil {
+		return s, fmt.Errorf("config: precision must be a number: %w", err)
+	}
+	if p != money.Precision() {
+		if err := money.SetPrecision(p); err != nil {
+			return s, fmt.Errorf("config: precision must be between 0 and %d, not %d", money.MaxPrecision, p)
+		}
+	}
+	err := viper.Unmarshal(&s, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(fieldsHook, amountHook)))
+	var decode *mapstructure.Error
+	if errors.As(err, &decode) {
+		// One error a key, as from validate.
+		var errs []error
+		for _, e := range decode.Errors {
+			errs = append(errs, errors.New("config: "+e))
+		}
+		return s, errors.Join(errs...)
+	}
+	if err != nil {
+		return s, fmt.Errorf("config: %w", err)
+	}
+	if err := s.validate(); err != nil {
+		return s, err
+	}
+	s.resolve(c.home)
+	return s, nil
 }
 
 // Home returns the home directory.
@@ -69,6 +189,110 @@ func (c *Config) Home() string {
 	return c.home
 }
 
+// Watch reads the config file again whenever it changes, until ctx is
+// done. A change to one of the live keys takes effect in the Settings
+// returned from then on. A change to any other key is refused: the key keeps its
+// value until the program restarts. report is called after each reload
+// with the keys applied and refused, the keys left to the environment or
+// the command line that set them, or with the error that kept the file
+// from loading or its settings from being valid.
+func (c *Config) Watch(ctx context.Context, live []string, report func(applied, refused, overridden []string, err error)) error {
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return errors.New("no config file to watch")
+	}
+	last, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	return filewatch.Watch(ctx, path, 200*time.Millisecond, func() {
+		now, err := readFile(path)
+		if err != nil {
+			report(nil, nil, nil, err)
+			return
+		}
+		applied, refused, overridden, err := c.apply(path, last, now, live)
+		last = now
+		if err != nil {
+			report(nil, nil, nil, err)
+			return
+		}
+		if len(applied)+len(refused)+len(overridden) > 0 {
+			report(applied, refused, overridden, nil)
+		}
+	})
+}
+
+// readFile returns the settings in the config file at path.
+func readFile(path string) (map[string]interface{}, error) {
+	vp := viper.New()
+	vp.SetConfigFile(path)
+	if err := vp.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	return vp.AllSettings(), nil
+}
+
+// apply sets the live keys that changed between the settings old and now
+// of the file at path, and returns them with the other keys that changed,
+// by the names used in the file. When the new values are not valid, none
+// is set and the error names them.
+func (c *Config) apply(path string, old, now map[string]interface{}, live []string) (applied, refused, overridden []string, err error) {
+	keys := map[string]bool{}
+	for k := range old {
+		keys[k] = true
+	}
+	for k := range now {
+		keys[k] = true
+	}
+	src, _ := os.ReadFile(path)
+	mu.Lock()
+	defer mu.Unlock()
+	before := map[string]interface{}{}
+	for k := range keys {
+		if reflect.DeepEqual(old[k], now[k]) {
+			continue
+		}
+		name := keyName(src, k)
+		if pinned[k] {
+			overridden = append(overridden, name)
+			continue
+		}
+		// A key removed from the file keeps its value.
+		switch {
+		case now[k] != nil && slices.ContainsFunc(live, func(l string) bool { return l == name || l == k }):
+			before[k] = viper.Get(k)
+			viper.Set(k, now[k])
+			applied = append(applied, name)
+		case !reflect.DeepEqual(viper.Get(k), now[k]):
+			// A key put back to the value in effect is not refused.
+			refused = append(refused, name)
+		}
+	}
+	s, err := c.decode()
+	if err != nil {
+		for k, v := range before {
+			viper.Set(k, v)
+		}
+		return nil, nil, nil, err
+	}
+	c.settings = s
+	sort.Strings(applied)
+	sort.Strings(refused)
+	sort.Strings(overridden)
+	return applied, refused, overridden, nil
+}
+
+// keyName returns key as it is spelled in the file src; viper knows keys
+// in lower case only.
+func keyName(src []byte, key string) string {
+	m := regexp.MustCompile(`(?im)^\s*(` + regexp.QuoteMeta(key) + `)\s*=`).FindSubmatch(src)
+	if m == nil {
+		return key
+	}
+	return string(m[1])
+}
+
 // Bin returns config bin directory.
 func (c *Config) Bin() string {
 	return c.home + "/bin"
@@ -81,3 +305,14 @@ func getHome() string {
 	}
 	return home + "/.config/enclave"
 }
+
+// Decode reads the file at path, in any format the config file may use,
+// into v.
+func Decode(path string, v interface{}) error {
+	vp := viper.New()
+	vp.SetConfigFile(path)
+	if err := vp.ReadInConfig(); err != nil {
+		return err
+	}
+	return vp.Unmarshal(v)
+}
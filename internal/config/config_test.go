@@ -0,0 +1,264 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/money"
+	"github.com/spf13/viper"
+)
+
+// readConfig writes src to a config file and reads it, with the -set
+// pairs set. The global viper and the pinned keys are reset around it.
+func readConfig(t *testing.T, src string, set ...string) (*Config, string, error) {
+	t.Helper()
+	reset := func() {
+		viper.Reset()
+		clear(pinned)
+		_ = money.SetPrecision(2)
+	}
+	reset()
+	t.Cleanup(reset)
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := read(path, "", set)
+	return c, path, err
+}
+
+func TestDefaults(t *testing.T) {
+	c, path, err := readConfig(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := c.Settings()
+	dir := filepath.Dir(path)
+	for _, tt := range []struct {
+		key       string
+		got, want interface{}
+	}{
+		{"numberOfNodes", s.NumberOfNodes, 19},
+		{"consensusDelay", s.ConsensusDelay, 1500 * time.Millisecond},
+		{"chartWindow", s.ChartWindow, 300 * time.Second},
+		{"openBal", s.OpenBal.String(), "1000.00"},
+		{"riskBlacklist", len(s.RiskBlacklist), 0},
+		{"logSinks", s.LogSinks, []string{"dashboard", "file"}},
+		{"sgxManifest", s.SgxManifest, filepath.Join(dir, "manifest.json")},
+		{"home", c.Home(), dir},
+	} {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.key, tt.got, tt.want)
+		}
+	}
+}
+
+func TestDefaultsMatchFile(t *testing.T) {
+	src, err := os.ReadFile("../../config/config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _, err := readConfig(t, string(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFile := c.Settings()
+	c, _, err = readConfig(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := c.Settings()
+	v, w := reflect.ValueOf(fromFile), reflect.ValueOf(defaults)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Tag.Get("config") == "path" {
+			// Resolved against different directories.
+			a, b := filepath.Base(v.Field(i).String()), filepath.Base(w.Field(i).String())
+			if a != b {
+				t.Errorf("%s: config.toml has %s, the default is %s", f.Name, a, b)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(v.Field(i).Interface(), w.Field(i).Interface()) &&
+			!(f.Type.Kind() == reflect.Slice && v.Field(i).Len() == 0 && w.Field(i).Len() == 0) {
+			t.Errorf("%s: config.toml has %v, the default is %v", f.Name, v.Field(i), w.Field(i))
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		src  string
+		want []string
+	}{
+		{"numberOfNodes = 0", []string{"config: numberOfNodes must be at least 1, not 0"}},
+		{"gaugeDelay = -1\nTCPport = \"x\"", []string{
+			"config: gaugeDelay must be at least 0, not -1",
+			`config: TCPport must be a port number, not "x"`,
+		}},
+		{"randFactor = 10\nmaxTransactions = 10", []string{"config: maxTransactions must be more than randFactor, not 10"}},
+		{"inputBlock = 100", []string{"config: inputBlock must be a percentage between 1 and 99, not 100"}},
+		{`openBal = "-1"`, []string{"config: openBal must be at least 0, not -1.00"}},
+		{`baseAsset = "ic"`, []string{`config: baseAsset must be an asset name in capitals, not "ic"`}},
+		{`quoteAsset = "IC"`, []string{`config: quoteAsset must be empty or an asset name in capitals other than baseAsset, not "IC"`}},
+		{`TCPconnect = "localhost"`, []string{`config: TCPconnect must be a host:port address, not "localhost"`}},
+		{`logLevel = "loud"`, []string{`config: logLevel must be debug, info, warn or error, not "loud"`}},
+		{`logSinks = ["file", "syslog"]`, []string{`config: logSinks must be a list of dashboard, file and stdout, not "syslog"`}},
+		{"precision = 12", []string{"config: precision must be between 0 and 9, not 12"}},
+		{`openBal = "1.005"`, []string{`config: error decoding 'openBal': "1.005" has more than 2 decimal places`}},
+		{`numberOfNodes = "many"`, []string{`config: cannot parse 'numberOfNodes' as int`}},
+	} {
+		_, _, err := readConfig(t, tt.src)
+		if err == nil {
+			t.Errorf("%q: no error", tt.src)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%q: error %q, want %q", tt.src, err, want)
+			}
+		}
+		if n := strings.Count(err.Error(), "\n") + 1; n < len(tt.want) {
+			t.Errorf("%q: %d errors, want %d", tt.src, n, len(tt.want))
+		}
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	t.Setenv(EnvPrefix+"_NUMBEROFNODES", "7")
+	t.Setenv(EnvPrefix+"_GAUGEINTERVAL", "3")
+	c, _, err := readConfig(t, "numberOfNodes = 5\ngaugeInterval = 2\nrandFactor = 9",
+		"gaugeinterval=4", "riskBlacklist=mallory eve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := c.Settings()
+	if s.NumberOfNodes != 7 || s.GaugeInterval != 4 || s.RandFactor != 9 {
+		t.Errorf("numberOfNodes, gaugeInterval, randFactor = %d, %d, %d; want 7 from the environment, "+
+			"4 from -set and 9 from the file", s.NumberOfNodes, s.GaugeInterval, s.RandFactor)
+	}
+	if !slices.Equal(s.RiskBlacklist, []string{"mallory", "eve"}) {
+		t.Errorf("riskBlacklist = %q, want mallory and eve", s.RiskBlacklist)
+	}
+	for _, set := range []string{"colour=red", "numberOfNodes"} {
+		if _, _, err := readConfig(t, "", set); err == nil || !strings.Contains(err.Error(), "-set "+set) {
+			t.Errorf("-set %s: error = %v", set, err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	c, path, err := readConfig(t, "loggerDelay = 1000\naccountID = \"a\"\nnumberOfNodes = 5", "numberOfNodes=6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := []string{"loggerDelay", "numberOfNodes"}
+	write := func(src string) map[string]interface{} {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		m, err := readFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	old := write("loggerDelay = 1000\naccountID = \"a\"\nnumberOfNodes = 5")
+
+	now := write("loggerDelay = 2000\naccountID = \"b\"\nnumberOfNodes = 8")
+	applied, refused, overridden, err := c.apply(path, old, now, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(applied, []string{"loggerDelay"}) || !slices.Equal(refused, []string{"accountID"}) ||
+		!slices.Equal(overridden, []string{"numberOfNodes"}) {
+		t.Errorf("apply = %q, %q, %q; want loggerDelay applied, accountID refused, numberOfNodes overridden",
+			applied, refused, overridden)
+	}
+	s := c.Settings()
+	if s.LoggerDelay != 2*time.Second || s.AccountID != "a" || s.NumberOfNodes != 6 {
+		t.Errorf("loggerDelay, accountID, numberOfNodes = %v, %q, %d; want 2s, a, 6", s.LoggerDelay, s.AccountID,
+			s.NumberOfNodes)
+	}
+
+	// A live key set to a bad value is not applied, and keeps the value
+	// before it.
+	old, now = now, write("loggerDelay = 0\naccountID = \"b\"\nnumberOfNodes = 8")
+	if _, _, _, err := c.apply(path, old, now, live); err == nil ||
+		err.Error() != "config: loggerDelay must be at least 1, not 0" {
+		t.Errorf("apply of loggerDelay = 0: error = %v", err)
+	}
+	if got := c.Settings().LoggerDelay; got != 2*time.Second {
+		t.Errorf("loggerDelay = %v after a bad value, want 2s", got)
+	}
+
+	// A refused key put back to the value in effect is not refused again.
+	old, now = now, write("loggerDelay = 2000\naccountID = \"a\"\nnumberOfNodes = 8")
+	applied, refused, _, err = c.apply(path, old, now, live)
+	if err != nil || len(refused) != 0 || !slices.Equal(applied, []string{"loggerDelay"}) {
+		t.Errorf("apply = %q, %q, %v; want loggerDelay applied and nothing refused", applied, refused, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	c, path, err := readConfig(t, "loggerDelay = 1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type report struct {
+		applied, refused []string
+		err              error
+	}
+	reports := make(chan report, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Watch(ctx, []string{"loggerDelay"}, func(applied, refused, _ []string, err error) {
+			reports <- report{applied, refused, err}
+		})
+	}()
+	time.Sleep(100 * time.Millisecond) // let the watch start
+	next := func(src string) report {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case r := <-reports:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no report after writing %q", src)
+		}
+		return report{}
+	}
+
+	if r := next("loggerDelay = 3000\nTCPport = \"6000\""); r.err != nil ||
+		!slices.Equal(r.applied, []string{"loggerDelay"}) || !slices.Equal(r.refused, []string{"TCPport"}) {
+		t.Errorf("report = %+v, want loggerDelay applied and TCPport refused", r)
+	}
+	if got := c.Settings().LoggerDelay; got != 3*time.Second {
+		t.Errorf("loggerDelay = %v, want 3s", got)
+	}
+	if r := next("loggerDelay = ["); r.err == nil {
+		t.Errorf("report of a file that does not parse = %+v, want an error", r)
+	}
+	if got := c.Settings().LoggerDelay; got != 3*time.Second {
+		t.Errorf("loggerDelay = %v after a bad file, want 3s", got)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Watch = %v, want nil", err)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/money"
+)
+
+// Settings are the keys of the config file. A field tagged config:"ms" or
+// config:"s" is given in the file in milliseconds or seconds; one tagged
+// config:"path" is resolved against the directory of the file.
+type Settings struct {
+	NumberOfNodes     int           `mapstructure:"numberOfNodes"`
+	NumberOfMoneyBags int           `mapstructure:"numberOfMoneyBags"`
+	ConsensusDelay    time.Duration `mapstructure:"consensusDelay" config:"ms"`
+	MoneyBagsDelay    time.Duration `mapstructure:"moneyBagsDelay" config:"ms"`
+
+	LoggerDelay time.Duration `mapstructure:"loggerDelay" config:"ms"`
+	PaneHistory int           `mapstructure:"paneHistory"`
+
+	GaugeDelay    time.Duration `mapstructure:"gaugeDelay" config:"ms"`
+	EndGaugeWait  time.Duration `mapstructure:"endGaugeWait" config:"ms"`
+	GaugeInterval int           `mapstructure:"gaugeInterval"`
+
+	MaxTransactions int `mapstructure:"maxTransactions"`
+	RandFactor      int `mapstructure:"randFactor"`
+
+	LayoutFile  string        `mapstructure:"layoutFile" config:"path"`
+	InputBlock  int           `mapstructure:"inputBlock"` // percent
+	ChartWindow time.Duration `mapstructure:"chartWindow" config:"s"`
+
+	OpenBal   money.Amount `mapstructure:"openBal"`
+	OpenQuote money.Amount `mapstructure:"openQuote"`
+	AccountID string       `mapstructure:"accountID"`
+
+	BaseAsset  string `mapstructure:"baseAsset"`
+	QuoteAsset string `mapstructure:"quoteAsset"`
+	Precision  int    `mapstructure:"precision"`
+
+	RiskMaxOrder    money.Amount  `mapstructure:"riskMaxOrder"`
+	RiskDailyVolume money.Amount  `mapstructure:"riskDailyVolume"`
+	RiskRate        int           `mapstructure:"riskRate"`
+	RiskRateWindow  time.Duration `mapstructure:"riskRateWindow" config:"s"`
+	RiskBlacklist   []string      `mapstructure:"riskBlacklist"`
+	RiskMaxHolding  money.Amount  `mapstructure:"riskMaxHolding"`
+	PolicyFile      string        `mapstructure:"policyFile" config:"path"`
+
+	TCPconnect     string        `mapstructure:"TCPconnect"`
+	TCPport        string        `mapstructure:"TCPport"`
+	TCPidleTimeout time.Duration `mapstructure:"TCPidleTimeout" config:"s"`
+
+	ClientHistory     string        `mapstructure:"clientHistory" config:"path"`
+	ClientHistorySize int           `mapstructure:"clientHistorySize"`
+	ClientTimeout     time.Duration `mapstructure:"clientTimeout" config:"s"`
+	ClientHeartbeat   time.Duration `mapstructure:"clientHeartbeat" config:"s"`
+	ClientReconnects  int           `mapstructure:"clientReconnects"` // 0 tries forever
+
+	SgxManifest   string        `mapstructure:"sgxManifest" config:"path"`
+	SgxPublicKey  string        `mapstructure:"sgxPublicKey" config:"path"`
+	SgxPrivateKey string        `mapstructure:"sgxPrivateKey" config:"path"`
+	SgxWatch      bool          `mapstructure:"sgxWatch"`
+	SgxDebounce   time.Duration `mapstructure:"sgxDebounce" config:"ms"`
+	SgxRescan     time.Duration `mapstructure:"sgxRescan" config:"s"`
+
+	TamperHaltTrading bool   `mapstructure:"tamperHaltTrading"`
+	TamperHaltBlocks  bool   `mapstructure:"tamperHaltBlocks"`
+	TamperQuarantine  bool   `mapstructure:"tamperQuarantine"`
+	QuarantineDir     string `mapstructure:"quarantineDir" config:"path"`
+	TamperRestore     bool   `mapstructure:"tamperRestore"`
+	TrustedDir        string `mapstructure:"trustedDir" config:"path"`
+	TamperIncidents   bool   `mapstructure:"tamperIncidents"`
+	IncidentLog       string `mapstructure:"incidentLog" config:"path"`
+
+	AuditLog string `mapstructure:"auditLog" config:"path"`
+
+	LogLevel    string   `mapstructure:"logLevel"`
+	LogSinks    []string `mapstructure:"logSinks"`
+	LogFile     string   `mapstructure:"logFile" config:"path"`
+	LogMaxSize  int      `mapstructure:"logMaxSize"` // megabytes
+	LogMaxFiles int      `mapstructure:"logMaxFiles"`
+}
+
+// defaults are the values of the keys missing from the config file, as
+// the file gives them. They match config/config.toml.
+var defaults = map[string]interface{}{
+	"numberOfNodes":     19,
+	"numberOfMoneyBags": 19,
+	"consensusDelay":    1500,
+	"moneyBagsDelay":    40,
+	"loggerDelay":       1000,
+	"paneHistory":       500,
+	"gaugeDelay":        1,
+	"endGaugeWait":      500,
+	"gaugeInterval":     1,
+	"maxTransactions":   2100,
+	"randFactor":        297,
+	"layoutFile":        "layout.toml",
+	"inputBlock":        80,
+	"chartWindow":       300,
+	"openBal":           "1000",
+	"openQuote":         "10000",
+	"accountID":         "030c8d4c-4e70-4cfe-a948-e5039cbf8f21",
+	"baseAsset":         "IC",
+	"quoteAsset":        "USD",
+	"precision":         2,
+	"riskMaxOrder":      "100000",
+	"riskDailyVolume":   "10000000",
+	"riskRate":          200,
+	"riskRateWindow":    1,
+	"riskBlacklist":     []string{},
+	"riskMaxHolding":    "0",
+	"policyFile":        "policy.rules",
+	"TCPconnect":        "localhost:5555",
+	"TCPport":           "5555",
+	"TCPidleTimeout":    0,
+	"clientHistory":     "client_history",
+	"clientHistorySize": 500,
+	"clientTimeout":     5,
+	"clientHeartbeat":   10,
+	"clientReconnects":  10,
+	"sgxManifest":       "manifest.json",
+	"sgxPublicKey":      "operator.pub",
+	"sgxPrivateKey":     "operator.key",
+	"sgxWatch":          true,
+	"sgxDebounce":       200,
+	"sgxRescan":         30,
+	"tamperHaltTrading": true,
+	"tamperHaltBlocks":  true,
+	"tamperQuarantine":  true,
+	"quarantineDir":     "quarantine",
+	"tamperRestore":     false,
+	"trustedDir":        "trusted",
+	"tamperIncidents":   true,
+	"incidentLog":       "incidents.log",
+	"auditLog":          "audit.log",
+	"logLevel":          "info",
+	"logSinks":          []string{"dashboard", "file"},
+	"logFile":           "enclave.log",
+	"logMaxSize":        10,
+	"logMaxFiles":       3,
+}
+
+// keyOf returns the key of the config file named key in any case, or "".
+func keyOf(key string) string {
+	t := reflect.TypeOf(Settings{})
+	for i := 0; i < t.NumField(); i++ {
+		if k := t.Field(i).Tag.Get("mapstructure"); strings.EqualFold(k, key) {
+			return k
+		}
+	}
+	return ""
+}
+
+// units are the durations of the config:"ms" and config:"s" tags.
+var units = map[string]time.Duration{"ms": time.Millisecond, "s": time.Second}
+
+// resolve scales the durations of s from the units of the file, and
+// resolves its relative paths against home.
+func (s *Settings) resolve(home string) {
+	v, t := reflect.ValueOf(s).Elem(), reflect.TypeOf(*s)
+	for i := 0; i < t.NumField(); i++ {
+		f, tag := v.Field(i), t.Field(i).Tag.Get("config")
+		switch {
+		case units[tag] != 0:
+			f.SetInt(f.Int() * int64(units[tag]))
+		case tag == "path" && f.String() != "" && !filepath.IsAbs(f.String()):
+			f.SetString(filepath.Join(home, f.String()))
+		}
+	}
+}
+
+// amountHook decodes a money.Amount from the decimal the file gives.
+func amountHook(from, to reflect.Type, v interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(money.Amount(0)) {
+		return v, nil
+	}
+	switch n := v.(type) {
+	case string:
+		if n == "" {
+			return money.Amount(0), nil
+		}
+		return money.Parse(n)
+	case float64:
+		return money.Parse(strconv.FormatFloat(n, 'f', -1, 64))
+	}
+	return money.Parse(fmt.Sprint(v))
+}
+
+// fieldsHook splits a string set for a list at white space.
+func fieldsHook(from, to reflect.Type, v interface{}) (interface{}, error) {
+	if from.Kind() == reflect.String && to.Kind() == reflect.Slice {
+		return strings.Fields(v.(string)), nil
+	}
+	return v, nil
+}
+
+var assetName = regexp.MustCompile(`^[A-Z][A-Z0-9]{0,9}$`)
+
+// validate checks the settings as the file gives them, before they are
+// resolved. The error names every bad key.
+func (s *Settings) validate() error {
+	var errs []error
+	check := func(ok bool, key, want string, value interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("config: %s must be %s, not %v", key, want, value))
+		}
+	}
+	atLeast := func(key string, value, least int) {
+		check(value >= least, key, "at least "+strconv.Itoa(least), value)
+	}
+	// Durations are still in the units of the file.
+	notNegative := func(key string, value time.Duration) {
+		atLeast(key, int(value), 0)
+	}
+	// randLeader and rand.Intn panic on an empty range.
+	atLeast("numberOfNodes", s.NumberOfNodes, 1)
+	atLeast("numberOfMoneyBags", s.NumberOfMoneyBags, 0)
+	notNegative("consensusDelay", s.ConsensusDelay)
+	notNegative("moneyBagsDelay", s.MoneyBagsDelay)
+	atLeast("loggerDelay", int(s.LoggerDelay), 1)
+	atLeast("paneHistory", s.PaneHistory, 1)
+	notNegative("gaugeDelay", s.GaugeDelay)
+	notNegative("endGaugeWait", s.EndGaugeWait)
+	atLeast("gaugeInterval", s.GaugeInterval, 1)
+	atLeast("randFactor", s.RandFactor, 1)
+	check(s.MaxTransactions > s.RandFactor, "maxTransactions", "more than randFactor", s.MaxTransactions)
+	check(s.InputBlock > 0 && s.InputBlock < 100, "inputBlock", "a percentage between 1 and 99", s.InputBlock)
+	atLeast("chartWindow", int(s.ChartWindow), 1)
+	for _, a := range []struct {
+		key   string
+		value money.Amount
+	}{
+		{"openBal", s.OpenBal}, {"openQuote", s.OpenQuote},
+		{"riskMaxOrder", s.RiskMaxOrder}, {"riskDailyVolume", s.RiskDailyVolume}, {"riskMaxHolding", s.RiskMaxHolding},
+	} {
+		check(a.value >= 0, a.key, "at least 0", a.value)
+	}
+	check(s.AccountID != "", "accountID", "set", `""`)
+	check(assetName.MatchString(s.BaseAsset), "baseAsset", "an asset name in capitals", strconv.Quote(s.BaseAsset))
+	check(s.QuoteAsset == "" || assetName.MatchString(s.QuoteAsset) && s.QuoteAsset != s.BaseAsset, "quoteAsset",
+		"empty or an asset name in capitals other than baseAsset", strconv.Quote(s.QuoteAsset))
+	atLeast("riskRate", s.RiskRate, 0)
+	notNegative("riskRateWindow", s.RiskRateWindow)
+	_, _, err := net.SplitHostPort(s.TCPconnect)
+	check(err == nil, "TCPconnect", "a host:port address", strconv.Quote(s.TCPconnect))
+	port, err := strconv.Atoi(s.TCPport)
+	check(err == nil && port > 0 && port < 65536, "TCPport", "a port number", strconv.Quote(s.TCPport))
+	notNegative("TCPidleTimeout", s.TCPidleTimeout)
+	atLeast("clientHistorySize", s.ClientHistorySize, 0)
+	notNegative("clientTimeout", s.ClientTimeout)
+	notNegative("clientHeartbeat", s.ClientHeartbeat)
+	atLeast("clientReconnects", s.ClientReconnects, 0)
+	notNegative("sgxDebounce", s.SgxDebounce)
+	atLeast("sgxRescan", int(s.SgxRescan), 1)
+	check(slices.Contains([]string{"debug", "info", "warn", "error"}, strings.ToLower(s.LogLevel)), "logLevel",
+		"debug, info, warn or error", strconv.Quote(s.LogLevel))
+	for _, sink := range s.LogSinks {
+		check(slices.Contains([]string{"dashboard", "file", "stdout"}, sink), "logSinks",
+			"a list of dashboard, file and stdout", strconv.Quote(sink))
+	}
+	atLeast("logMaxSize", s.LogMaxSize, 1)
+	atLeast("logMaxFiles", s.LogMaxFiles, 0)
+	return errors.Join(errs...)
+}
@@ -53,3 +53,24 @@ func randList(n int) []int {
 	}
 	return result
 }
+
+// ChangeLeader makes another node of the group its leader.
+func ChangeLeader(group *[]nodeID) {
+	nodes := *group
+	if len(nodes) < 2 {
+		return
+	}
+	old := 0
+	for i, n := range nodes {
+		if n.IsLeader {
+			old = i
+		}
+	}
+	leader := randLeader(len(nodes) - 1)
+	if leader >= old {
+		leader++
+	}
+	for i := range nodes {
+		nodes[i].IsLeader = i == leader
+	}
+}
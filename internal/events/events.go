@@ -0,0 +1,65 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+// Package events carries what happens in the simulation, such as new
+// blocks, balance changes and enclave scans, to the panels that chart it.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event kinds.
+const (
+	Block   = "block"   // Value is the number of transactions in the block
+	Balance = "balance" // Value is the account balance after a trade
+	Scan    = "scan"    // Value is the time taken by a full enclave scan, in ms
+)
+
+// Event is one measurement taken by the simulation.
+type Event struct {
+	Kind  string
+	Time  time.Time
+	Value float64
+}
+
+// Bus passes every published event to every subscriber. A nil *Bus
+// discards events. It is safe for concurrent use.
+type Bus struct {
+	mu   sync.Mutex
+	subs []chan Event
+}
+
+// NewBus returns a Bus with no subscribers.
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe returns a channel that receives every event published from
+// now on. Events are dropped rather than block the simulation when more
+// than size of them are waiting.
+func (b *Bus) Subscribe(size int) <-chan Event {
+	ch := make(chan Event, size)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, ch)
+	return ch
+}
+
+// Publish sends an event of the given kind, taken now, to the subscribers.
+func (b *Bus) Publish(kind string, value float64) {
+	if b == nil {
+		return
+	}
+	e := Event{Kind: kind, Time: time.Now(), Value: value}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+// Package filewatch reports the changes to a file.
+package filewatch
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch calls changed whenever the file at path changes, until ctx is
+// done. A burst of events is reported once, settle after the last of
+// them. The file may be created or replaced after Watch starts.
+func Watch(ctx context.Context, path string, settle time.Duration, changed func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	// Editors replace files, so the directory is watched.
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(ev.Name) == filepath.Clean(path) {
+				t.Reset(settle)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case <-t.C:
+			changed()
+		}
+	}
+}
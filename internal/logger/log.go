@@ -0,0 +1,260 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/donaldww/idemo2/internal/config"
+	"github.com/mum4k/termdash/cell"
+)
+
+// Components tag each record with the part of the simulator that wrote it.
+const (
+	TCP        = "tcp"
+	SGX        = "sgx"
+	Consensus  = "consensus"
+	Blockchain = "blockchain"
+	Config     = "config"
+)
+
+// componentKey is the attribute that carries the component tag.
+const componentKey = "component"
+
+var (
+	baseMu sync.RWMutex
+	base   = slog.Default()
+)
+
+// For returns a logger that tags every record with component.
+// Until Setup is called records go to the standard logger.
+func For(component string) *slog.Logger {
+	baseMu.RLock()
+	defer baseMu.RUnlock()
+	return base.With(componentKey, component)
+}
+
+// Setup builds the logging layer from the log* keys in the config file.
+//
+// The "dashboard" sink routes each record to the pane registered for its
+// component in panes, or to the pane registered for "" if there is none;
+// a record whose pane is full is dropped from the dashboard. The "file" sink writes text records to logFile, rotating it after
+// logMaxSize megabytes and keeping logMaxFiles old files. The "stdout"
+// sink writes JSON records to standard output.
+//
+// The returned Closer closes the log file, if any.
+func Setup(cf *config.Config, panes map[string]chan MSG) (io.Closer, error) {
+	s := cf.Settings()
+	var level slog.Level
+	if s.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(s.LogLevel)); err != nil {
+			return nil, fmt.Errorf("logLevel: %w", err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var (
+		handlers fanout
+		closer   io.Closer = nopCloser{}
+	)
+	for _, sink := range s.LogSinks {
+		switch sink {
+		case "dashboard":
+			handlers = append(handlers, &dashboardHandler{level: level, panes: panes})
+		case "file":
+			f, err := openRotating(s.LogFile, int64(s.LogMaxSize)<<20,
+				s.LogMaxFiles)
+			if err != nil {
+				return nil, err
+			}
+			closer = f
+			handlers = append(handlers, slog.NewTextHandler(f, opts))
+		case "stdout":
+			handlers = append(handlers, slog.NewJSONHandler(os.Stdout, opts))
+		default:
+			return nil, fmt.Errorf("logSinks: unknown sink %q", sink)
+		}
+	}
+	baseMu.Lock()
+	base = slog.New(handlers)
+	baseMu.Unlock()
+	return closer, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// fanout sends each record to every handler that accepts its level.
+type fanout []slog.Handler
+
+func (f fanout) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanout) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (f fanout) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (f fanout) WithGroup(name string) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// dashboardHandler writes the message of each record into a dashboard
+// pane, colored by level. Fields are left to the other sinks, since the
+// panes are too narrow to show them.
+type dashboardHandler struct {
+	level     slog.Level
+	panes     map[string]chan MSG
+	component string
+}
+
+func (h *dashboardHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level
+}
+
+func (h *dashboardHandler) Handle(_ context.Context, r slog.Record) error {
+	ch, ok := h.panes[h.component]
+	if !ok {
+		ch, ok = h.panes[""]
+	}
+	if !ok {
+		return nil
+	}
+	// A full pane, or one no longer read since the dashboard stopped,
+	// drops the message rather than stall the caller, which may hold a
+	// lock.
+	select {
+	case ch <- MSG{Msg: r.Message, Color: levelColor(r.Level)}:
+	default:
+	}
+	return nil
+}
+
+func (h *dashboardHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	for _, a := range attrs {
+		if a.Key == componentKey {
+			c.component = a.Value.String()
+		}
+	}
+	return &c
+}
+
+func (h *dashboardHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// levelColor returns the dashboard color for a level.
+func levelColor(l slog.Level) cell.Color {
+	switch {
+	case l >= slog.LevelError:
+		return cell.ColorRed
+	case l >= slog.LevelWarn:
+		return cell.ColorYellow
+	case l >= slog.LevelInfo:
+		return cell.ColorGreen
+	default:
+		return cell.ColorDefault
+	}
+}
+
+// rotatingFile is an append-only log file that is renamed to path.1,
+// path.2, ... once it grows past maxSize.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func openRotating(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	for i := r.maxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.maxFiles > 0 {
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
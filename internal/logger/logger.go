@@ -7,13 +7,15 @@ package logger
 import (
 	"context"
 	"fmt"
+	"github.com/donaldww/idemo2/internal/audit"
 	"github.com/donaldww/idemo2/internal/config"
+	"github.com/donaldww/idemo2/internal/response"
 	"github.com/donaldww/idemo2/internal/sgx"
 	"github.com/donaldww/idemo2/internal/term"
+	"log/slog"
 	"time"
 
 	"github.com/mum4k/termdash/cell"
-	"github.com/mum4k/termdash/widgets/text"
 )
 
 type MSG struct {
@@ -21,19 +23,13 @@ type MSG struct {
 	Color cell.Color
 }
 
-// WriteLogger logs messages into the SGX monitor widget.
-func WriteLogger(_ context.Context, t *text.Text, loggerCH chan MSG, cf *config.Config) {
-	counter := 0
-	loggerRefresh := cf.GetInt("loggerRefresh")
+// WriteLogger logs messages into a dashboard pane.
+func WriteLogger(ctx context.Context, p *term.Pane, loggerCH chan MSG) {
 	for {
 		select {
 		case log := <-loggerCH:
-			if counter >= loggerRefresh {
-				t.Reset()
-				counter = 0
-			}
 			tNow := time.Now()
-			term.WriteColorf(t, log.Color, " %s: %s\n",
+			p.WriteColorf(log.Color, " %s: %s\n",
 				time.Date(
 					tNow.Year(), tNow.Month(), tNow.Day(),
 					tNow.Hour(), tNow.Minute(), tNow.Second(), tNow.Nanosecond(),
@@ -41,21 +37,73 @@ func WriteLogger(_ context.Context, t *text.Text, loggerCH chan MSG, cf *config.
 				),
 				log.Msg,
 			)
-			counter++
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func ScanEnclave(loggerCH chan MSG, cf *config.Config) {
-	loggerDelay := cf.GetMilliseconds("loggerDelay")
+// ScanEnclave reports the state of the enclave into the SGX monitor widget.
+// With sgxWatch set it reacts to file system events as they happen,
+// otherwise it rescans the enclave every loggerDelay.
+func ScanEnclave(ctx context.Context, en *sgx.Enclave, r *response.Responder, al *audit.Log, cf *config.Config) {
+	log := For(SGX)
+	// Verdicts are audited only when they change, not on every scan.
+	last := "-"
+	report := func(changes []sgx.Change) {
+		reportEnclave(log, r, changes)
+		if v := fmt.Sprint(changes); v != last {
+			last = v
+			verdict, fields := "verified", map[string]string{}
+			if len(changes) > 0 {
+				verdict = "tampered"
+			}
+			for _, c := range changes {
+				fields[c.Path] = string(c.Kind)
+			}
+			Audit(log, al, audit.Enclave, verdict, fields)
+		}
+	}
+	if cf.Settings().SgxWatch {
+		err := en.Watch(ctx, report)
+		if err == nil {
+			return
+		}
+		log.Error("SGX watcher failed, polling instead.", "err", err)
+	}
 	for {
-		sgx.Scan()
-		if err := sgx.IsValid(); err != nil {
-			loggerCH <- MSG{Msg: fmt.Sprintf("%v", err), Color: cell.ColorRed}
+		if err := en.Scan(); err != nil {
+			log.Error("SGX SIMULATOR ENCLAVE: scan failed.", "err", err)
 		} else {
-			loggerCH <- MSG{Msg: "SGX SIMULATOR ENCLAVE: Verified.", Color: cell.ColorGreen}
+			report(en.Diff())
+		}
+		select {
+		case <-time.After(cf.Settings().LoggerDelay):
+		case <-en.ScanRequests():
+		case <-ctx.Done():
+			return
 		}
-		sgx.Reset()
-		time.Sleep(loggerDelay)
+	}
+}
+
+// Audit appends a record to the audit log, logging any failure to log.
+func Audit(log *slog.Logger, al *audit.Log, kind, msg string, fields map[string]string) {
+	if err := al.Append(kind, msg, fields); err != nil {
+		log.Error("AUDIT LOG: append failed.", "err", err)
+	}
+}
+
+// reportEnclave logs one line per discrepancy, so simultaneous changes
+// are all reported, followed by the response actions taken.
+func reportEnclave(log *slog.Logger, r *response.Responder, changes []sgx.Change) {
+	if len(changes) == 0 {
+		log.Info("SGX SIMULATOR ENCLAVE: Verified.")
+	}
+	for _, c := range changes {
+		log.Error(c.String(), "kind", c.Kind, "path", c.Path, "oldHash", c.OldHash, "newHash", c.NewHash,
+			"oldMode", c.OldMode, "newMode", c.NewMode)
+	}
+	for _, action := range r.Handle(changes) {
+		log.Warn(action)
 	}
 }
@@ -0,0 +1,132 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+// Package money holds amounts of assets as fixed-point decimals.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// MaxPrecision is the most decimal places an Amount may have.
+const MaxPrecision = 9
+
+// ErrOverflow is returned when an amount does not fit in an Amount.
+var ErrOverflow = errors.New("amount too large")
+
+// Every Amount has precision decimal places: it counts units of
+// 1/scale.
+var (
+	precision       = 2
+	scale     int64 = 100
+)
+
+// Amount is a fixed-point decimal, such as a balance or a price.
+type Amount int64
+
+// SetPrecision sets the number of decimal places of every Amount. It is
+// called once, before any Amount is made.
+func SetPrecision(p int) error {
+	if p < 0 || p > MaxPrecision {
+		return fmt.Errorf("precision %d is not between 0 and %d", p, MaxPrecision)
+	}
+	precision, scale = p, 1
+	for i := 0; i < p; i++ {
+		scale *= 10
+	}
+	return nil
+}
+
+// Precision returns the number of decimal places of every Amount.
+func Precision() int {
+	return precision
+}
+
+// Parse parses a decimal such as "10", "-3" or "2.50". It may have at
+// most Precision decimal places.
+func Parse(s string) (Amount, error) {
+	digits := strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	whole, frac, _ := strings.Cut(digits, ".")
+	if whole == "" && frac == "" || !isDigits(whole) || !isDigits(frac) {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	if len(frac) > precision {
+		return 0, fmt.Errorf("%q has more than %d decimal places", s, precision)
+	}
+	n, ok := new(big.Int).SetString("0"+whole+frac+strings.Repeat("0", precision-len(frac)), 10)
+	if !ok || !n.IsInt64() {
+		return 0, ErrOverflow
+	}
+	a := Amount(n.Int64())
+	if strings.HasPrefix(s, "-") {
+		a = -a
+	}
+	return a, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the amount with Precision decimal places.
+func (a Amount) String() string {
+	sign, n := "", new(big.Int).SetInt64(int64(a))
+	if n.Sign() < 0 {
+		sign = "-"
+		n.Neg(n)
+	}
+	q, r := new(big.Int).QuoRem(n, big.NewInt(scale), new(big.Int))
+	if precision == 0 {
+		return sign + q.String()
+	}
+	return fmt.Sprintf("%s%s.%0*s", sign, q, precision, r)
+}
+
+// Float64 returns the amount as a float, for charts.
+func (a Amount) Float64() float64 {
+	return float64(a) / float64(scale)
+}
+
+// Add returns a+b, or ErrOverflow.
+func (a Amount) Add(b Amount) (Amount, error) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, ErrOverflow
+	}
+	return a + b, nil
+}
+
+// Mul returns the amount times a price, rounded towards zero, or
+// ErrOverflow.
+func (a Amount) Mul(price Amount) (Amount, error) {
+	return a.mul(price, false)
+}
+
+// MulUp returns the amount times a price, rounded away from zero, or
+// ErrOverflow. A cost paid by the trader is rounded up, so that no order
+// is too small to pay for.
+func (a Amount) MulUp(price Amount) (Amount, error) {
+	return a.mul(price, true)
+}
+
+func (a Amount) mul(price Amount, up bool) (Amount, error) {
+	n := new(big.Int).Mul(big.NewInt(int64(a)), big.NewInt(int64(price)))
+	var r big.Int
+	n.QuoRem(n, big.NewInt(scale), &r)
+	if up && r.Sign() != 0 {
+		n.Add(n, big.NewInt(int64(r.Sign())))
+	}
+	if !n.IsInt64() {
+		return 0, ErrOverflow
+	}
+	return Amount(n.Int64()), nil
+}
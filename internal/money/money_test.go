@@ -0,0 +1,161 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package money
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// withPrecision sets the precision for the rest of the test.
+func withPrecision(t *testing.T, p int) {
+	t.Helper()
+	old := Precision()
+	if err := SetPrecision(p); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = SetPrecision(old) })
+}
+
+func TestParse(t *testing.T) {
+	withPrecision(t, 2)
+	for _, tt := range []struct {
+		in   string
+		want Amount
+	}{
+		{"10", 1000},
+		{"2.5", 250},
+		{"2.50", 250},
+		{"0.01", 1},
+		{".5", 50},
+		{"7.", 700},
+		{"+3", 300},
+		{"-3.25", -325},
+		{"0", 0},
+		{"92233720368547758.07", math.MaxInt64},
+	} {
+		got, err := Parse(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	withPrecision(t, 2)
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{"", `"" is not a number`},
+		{".", `"." is not a number`},
+		{"-", `"-" is not a number`},
+		{"abc", `"abc" is not a number`},
+		{"1e3", `"1e3" is not a number`},
+		{"1,000", `"1,000" is not a number`},
+		{"1.2.3", `"1.2.3" is not a number`},
+		{"--1", `"--1" is not a number`},
+		{" 1", `" 1" is not a number`},
+		{"1.234", `"1.234" has more than 2 decimal places`},
+		{"0.001", `"0.001" has more than 2 decimal places`},
+	} {
+		_, err := Parse(tt.in)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("Parse(%q) error = %v, want %s", tt.in, err, tt.want)
+		}
+	}
+	if _, err := Parse("92233720368547758.08"); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Parse of MaxInt64+1 units: error = %v, want ErrOverflow", err)
+	}
+}
+
+func TestParsePrecision(t *testing.T) {
+	for _, tt := range []struct {
+		precision int
+		in        string
+		want      Amount
+		ok        bool
+	}{
+		{0, "12", 12, true},
+		{0, "12.", 12, true},
+		{0, "12.5", 0, false},
+		{3, "1.5", 1500, true},
+		{3, "1.234", 1234, true},
+		{3, "1.2345", 0, false},
+	} {
+		withPrecision(t, tt.precision)
+		got, err := Parse(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("precision %d: Parse(%q) = %d, %v; want %d, ok %v", tt.precision, tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	withPrecision(t, 2)
+	for _, tt := range []struct {
+		in   Amount
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{-5, "-0.05"},
+		{1234, "12.34"},
+		{math.MinInt64, "-92233720368547758.08"},
+	} {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Amount(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+	}
+}
+
+func TestMulRounds(t *testing.T) {
+	withPrecision(t, 2)
+	for _, tt := range []struct {
+		amount, price string
+		down, up      string
+	}{
+		{"10", "2.50", "25.00", "25.00"},
+		{"0.01", "0.50", "0.00", "0.01"},   // 0.005
+		{"0.03", "0.33", "0.00", "0.01"},   // 0.0099
+		{"3.33", "3.33", "11.08", "11.09"}, // 11.0889
+		{"-3.33", "3.33", "-11.08", "-11.09"},
+	} {
+		a, _ := Parse(tt.amount)
+		p, _ := Parse(tt.price)
+		got, err := a.Mul(p)
+		if err != nil || got.String() != tt.down {
+			t.Errorf("%s.Mul(%s) = %s, %v; want %s", tt.amount, tt.price, got, err, tt.down)
+		}
+		got, err = a.MulUp(p)
+		if err != nil || got.String() != tt.up {
+			t.Errorf("%s.MulUp(%s) = %s, %v; want %s", tt.amount, tt.price, got, err, tt.up)
+		}
+	}
+	if _, err := Amount(math.MaxInt64).Mul(200); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Mul overflow: error = %v, want ErrOverflow", err)
+	}
+	if _, err := Amount(math.MaxInt64).MulUp(200); !errors.Is(err, ErrOverflow) {
+		t.Errorf("MulUp overflow: error = %v, want ErrOverflow", err)
+	}
+}
+
+func TestAddOverflow(t *testing.T) {
+	for _, tt := range []struct {
+		a, b Amount
+		ok   bool
+	}{
+		{1, 2, true},
+		{math.MaxInt64, 1, false},
+		{math.MinInt64, -1, false},
+		{math.MaxInt64, -1, true},
+	} {
+		_, err := tt.a.Add(tt.b)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d.Add(%d) error = %v, want ok %v", int64(tt.a), int64(tt.b), err, tt.ok)
+		}
+	}
+}
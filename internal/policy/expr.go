@@ -0,0 +1,452 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// typ is the type of an expression. Types are checked when a policy is
+// loaded, so evaluation fails only on a division by zero.
+type typ int
+
+const (
+	number typ = iota
+	text
+	boolean
+)
+
+func (t typ) String() string {
+	return [...]string{"number", "string", "bool"}[t]
+}
+
+// expr is a compiled expression.
+type expr struct {
+	typ  typ
+	eval func(*Env) any // float64, string or bool, by typ
+}
+
+// evalError stops the evaluation of a condition that cannot be
+// computed; Rule.Matches recovers it.
+type evalError struct{ err error }
+
+// fields are the names an expression may use.
+var fields = map[string]expr{
+	"account": {text, func(e *Env) any { return e.Account }},
+	"side":    {text, func(e *Env) any { return e.Side }},
+	"asset":   {text, func(e *Env) any { return e.Asset }},
+	"to":      {text, func(e *Env) any { return e.To }},
+	"amount":  {number, func(e *Env) any { return e.Amount }},
+	"price":   {number, func(e *Env) any { return e.Price }},
+	"cost":    {number, func(e *Env) any { return e.Amount * e.Price }},
+	"holding": {number, func(e *Env) any { return e.Holdings[e.Asset] }},
+	"volume":  {number, func(e *Env) any { return e.Volume }},
+	"hour":    {number, func(e *Env) any { return float64(e.Time.Hour()) }},
+	"weekday": {text, func(e *Env) any { return e.Time.Weekday().String()[:3] }},
+}
+
+// token is a lexical token: a number, a "string", a name or an operator.
+type token struct {
+	kind byte // 'n'umber, 's'tring, 'i'dentifier, 'o'perator or 'e'nd
+	text string
+	pos  int
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "(", ")", "[", "]", ","}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{'n', src[i:j], i})
+			i = j
+		case c == '"':
+			j := strings.IndexByte(src[i+1:], '"')
+			if j < 0 {
+				return nil, fmt.Errorf("column %d: unterminated string", i+1)
+			}
+			toks = append(toks, token{'s', src[i+1 : i+1+j], i})
+			i += j + 2
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			toks = append(toks, token{'i', src[i:j], i})
+			i = j
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("column %d: unexpected %q", i+1, c)
+			}
+			toks = append(toks, token{'o', op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{'e', "end of rule", len(src)}), nil
+}
+
+// parser compiles an expression by recursive descent:
+//
+//	or      = and { "||" and }
+//	and     = not { "&&" not }
+//	not     = "!" not | compare
+//	compare = sum [ ("==" | "!=" | "<" | "<=" | ">" | ">=") sum | "in" list ]
+//	sum     = product { ("+" | "-") product }
+//	product = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | string | "true" | "false" | field
+//	        | "held" "(" or ")" | "(" or ")"
+//	list    = "[" [ or { "," or } ] "]"
+type parser struct {
+	toks []token
+	i    int
+}
+
+// compile compiles a condition, which must be a bool.
+func compile(src string) (expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return expr{}, err
+	}
+	p := &parser{toks: toks}
+	e, err := p.or()
+	if err != nil {
+		return expr{}, err
+	}
+	if t := p.peek(); t.kind != 'e' {
+		return expr{}, p.errorf(t, "unexpected %q", t.text)
+	}
+	if e.typ != boolean {
+		return expr{}, fmt.Errorf("the condition is a %s, not a bool", e.typ)
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != 'e' {
+		p.i++
+	}
+	return t
+}
+
+// accept consumes the next token if it is one of the operators or names.
+func (p *parser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	for _, op := range ops {
+		if (t.kind == 'o' || t.kind == 'i') && t.text == op {
+			p.i++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		t := p.peek()
+		return p.errorf(t, "want %q, not %q", op, t.text)
+	}
+	return nil
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return fmt.Errorf("column %d: %s", t.pos+1, fmt.Sprintf(format, args...))
+}
+
+// want checks the type of an operand.
+func (p *parser) want(t token, e expr, ty typ, op string) error {
+	if e.typ != ty {
+		return p.errorf(t, "%s needs a %s, not a %s", op, ty, e.typ)
+	}
+	return nil
+}
+
+func (p *parser) or() (expr, error) {
+	return p.logical("||", p.and, func(a, b func(*Env) any) func(*Env) any {
+		return func(e *Env) any { return a(e).(bool) || b(e).(bool) }
+	})
+}
+
+func (p *parser) and() (expr, error) {
+	return p.logical("&&", p.not, func(a, b func(*Env) any) func(*Env) any {
+		return func(e *Env) any { return a(e).(bool) && b(e).(bool) }
+	})
+}
+
+func (p *parser) logical(op string, operand func() (expr, error), join func(a, b func(*Env) any) func(*Env) any) (expr, error) {
+	t := p.peek()
+	l, err := operand()
+	if err != nil {
+		return expr{}, err
+	}
+	for {
+		if _, ok := p.accept(op); !ok {
+			return l, nil
+		}
+		rt := p.peek()
+		r, err := operand()
+		if err != nil {
+			return expr{}, err
+		}
+		if err := p.want(t, l, boolean, op); err != nil {
+			return expr{}, err
+		}
+		if err := p.want(rt, r, boolean, op); err != nil {
+			return expr{}, err
+		}
+		l = expr{boolean, join(l.eval, r.eval)}
+	}
+}
+
+func (p *parser) not() (expr, error) {
+	if _, ok := p.accept("!"); !ok {
+		return p.compare()
+	}
+	t := p.peek()
+	x, err := p.not()
+	if err != nil {
+		return expr{}, err
+	}
+	if err := p.want(t, x, boolean, "!"); err != nil {
+		return expr{}, err
+	}
+	return expr{boolean, func(e *Env) any { return !x.eval(e).(bool) }}, nil
+}
+
+func (p *parser) compare() (expr, error) {
+	t := p.peek()
+	l, err := p.sum()
+	if err != nil {
+		return expr{}, err
+	}
+	if _, ok := p.accept("in"); ok {
+		return p.in(t, l)
+	}
+	op, ok := p.accept("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return l, nil
+	}
+	rt := p.peek()
+	r, err := p.sum()
+	if err != nil {
+		return expr{}, err
+	}
+	if l.typ != r.typ {
+		return expr{}, p.errorf(rt, "%s compares a %s with a %s", op, l.typ, r.typ)
+	}
+	if op != "==" && op != "!=" && l.typ == boolean {
+		return expr{}, p.errorf(t, "%s cannot order bools", op)
+	}
+	return expr{boolean, func(e *Env) any {
+		a, b := l.eval(e), r.eval(e)
+		if op == "==" || op == "!=" {
+			return (a == b) == (op == "==")
+		}
+		var c int
+		if l.typ == number {
+			c = compareNumbers(a.(float64), b.(float64))
+		} else {
+			c = strings.Compare(a.(string), b.(string))
+		}
+		switch op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	}}, nil
+}
+
+func compareNumbers(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// in tests the membership of x in a list of values of its type.
+func (p *parser) in(t token, x expr) (expr, error) {
+	if err := p.expect("["); err != nil {
+		return expr{}, err
+	}
+	var items []expr
+	for {
+		if _, ok := p.accept("]"); ok {
+			break
+		}
+		if len(items) > 0 {
+			if err := p.expect(","); err != nil {
+				return expr{}, err
+			}
+		}
+		it := p.peek()
+		item, err := p.or()
+		if err != nil {
+			return expr{}, err
+		}
+		if item.typ != x.typ {
+			return expr{}, p.errorf(it, "in needs a list of %ss, not a %s", x.typ, item.typ)
+		}
+		items = append(items, item)
+	}
+	return expr{boolean, func(e *Env) any {
+		v := x.eval(e)
+		for _, item := range items {
+			if item.eval(e) == v {
+				return true
+			}
+		}
+		return false
+	}}, nil
+}
+
+func (p *parser) sum() (expr, error) {
+	return p.arithmetic([]string{"+", "-"}, p.product)
+}
+
+func (p *parser) product() (expr, error) {
+	return p.arithmetic([]string{"*", "/"}, p.unary)
+}
+
+func (p *parser) arithmetic(ops []string, operand func() (expr, error)) (expr, error) {
+	t := p.peek()
+	l, err := operand()
+	if err != nil {
+		return expr{}, err
+	}
+	for {
+		ot := p.peek()
+		op, ok := p.accept(ops...)
+		if !ok {
+			return l, nil
+		}
+		rt := p.peek()
+		r, err := operand()
+		if err != nil {
+			return expr{}, err
+		}
+		if err := p.want(t, l, number, op); err != nil {
+			return expr{}, err
+		}
+		if err := p.want(rt, r, number, op); err != nil {
+			return expr{}, err
+		}
+		a, b := l.eval, r.eval
+		l = expr{number, func(e *Env) any {
+			x, y := a(e).(float64), b(e).(float64)
+			switch op {
+			case "+":
+				return x + y
+			case "-":
+				return x - y
+			case "*":
+				return x * y
+			}
+			if y == 0 {
+				panic(evalError{p.errorf(ot, "division by zero")})
+			}
+			return x / y
+		}}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	if _, ok := p.accept("-"); !ok {
+		return p.primary()
+	}
+	t := p.peek()
+	x, err := p.unary()
+	if err != nil {
+		return expr{}, err
+	}
+	if err := p.want(t, x, number, "-"); err != nil {
+		return expr{}, err
+	}
+	return expr{number, func(e *Env) any { return -x.eval(e).(float64) }}, nil
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case 'n':
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return expr{}, p.errorf(t, "bad number %q", t.text)
+		}
+		return expr{number, func(*Env) any { return n }}, nil
+	case 's':
+		s := t.text
+		return expr{text, func(*Env) any { return s }}, nil
+	case 'i':
+		switch t.text {
+		case "true", "false":
+			b := t.text == "true"
+			return expr{boolean, func(*Env) any { return b }}, nil
+		case "held":
+			return p.held()
+		}
+		if f, ok := fields[t.text]; ok {
+			return f, nil
+		}
+		return expr{}, p.errorf(t, "unknown name %q", t.text)
+	case 'o':
+		if t.text == "(" {
+			x, err := p.or()
+			if err != nil {
+				return expr{}, err
+			}
+			return x, p.expect(")")
+		}
+	}
+	return expr{}, p.errorf(t, "unexpected %q", t.text)
+}
+
+// held is the holding of the account in the named asset.
+func (p *parser) held() (expr, error) {
+	if err := p.expect("("); err != nil {
+		return expr{}, err
+	}
+	t := p.peek()
+	x, err := p.or()
+	if err != nil {
+		return expr{}, err
+	}
+	if err := p.want(t, x, text, "held"); err != nil {
+		return expr{}, err
+	}
+	if err := p.expect(")"); err != nil {
+		return expr{}, err
+	}
+	return expr{number, func(e *Env) any { return e.Holdings[x.eval(e).(string)] }}, nil
+}
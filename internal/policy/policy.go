@@ -0,0 +1,162 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+// Package policy evaluates the order rules of a policy file.
+//
+// A policy file holds one rule a line:
+//
+//	# Blank lines and lines starting with # are ignored.
+//	mode dry-run
+//	allow treasury: to == "treasury"
+//	deny big-sells: side == "sell" && amount > 5000
+//	deny night: hour < 6 && cost > held("USD") / 2
+//
+// The first rule whose condition holds allows or denies the order; an
+// order that no rule matches is allowed. A condition that divides by zero
+// fails its rule, which then refuses the order even if it allows. "mode dry-run" reports the
+// decisions without enforcing them; "mode enforce" is the default.
+//
+// A condition combines the fields of the order and its account, numbers,
+// "strings", true and false with || && ! == != < <= > >= + - * /, "in"
+// followed by a [list], and held("ASSET"), the holding of an asset. The
+// fields are account, side (buy, sell or transfer), asset, to, amount,
+// price, cost (amount times price), holding (of the asset), volume (of
+// the asset traded today, before the order), hour (0 to 23) and weekday
+// (Mon to Sun).
+package policy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/filewatch"
+)
+
+// Env is what the rules see of an order and its account.
+type Env struct {
+	Time     time.Time
+	Account  string
+	Side     string
+	Asset    string
+	To       string
+	Amount   float64
+	Price    float64
+	Volume   float64            // of the asset traded by the account today, before the order
+	Holdings map[string]float64 // of the account, before the order
+}
+
+// Rule allows or denies the orders that meet its condition.
+type Rule struct {
+	Name      string
+	Allow     bool
+	Condition string // as written
+	Line      int
+	cond      expr
+}
+
+// Policy is the rules of a policy file, in order.
+type Policy struct {
+	Path   string
+	DryRun bool // report the decisions without enforcing them
+	Rules  []Rule
+}
+
+var ruleLine = regexp.MustCompile(`^(allow|deny)\s+([\w-]+)\s*:\s*(.*)$`)
+
+// Load reads the policy file at path.
+func Load(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(path, f)
+}
+
+// Parse reads a policy from r. Errors name the file and the line.
+func Parse(path string, r io.Reader) (*Policy, error) {
+	p := &Policy{Path: path}
+	names := map[string]int{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if mode, ok := strings.CutPrefix(line, "mode "); ok {
+			switch strings.TrimSpace(mode) {
+			case "enforce":
+				p.DryRun = false
+			case "dry-run":
+				p.DryRun = true
+			default:
+				return nil, fmt.Errorf("%s:%d: mode must be enforce or dry-run", path, n)
+			}
+			continue
+		}
+		m := ruleLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("%s:%d: want allow|deny <name>: <condition>", path, n)
+		}
+		if first, ok := names[m[2]]; ok {
+			return nil, fmt.Errorf("%s:%d: rule %s is already on line %d", path, n, m[2], first)
+		}
+		names[m[2]] = n
+		cond, err := compile(m[3])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: rule %s: %v", path, n, m[2], err)
+		}
+		p.Rules = append(p.Rules, Rule{Name: m[2], Allow: m[1] == "allow", Condition: m[3], Line: n, cond: cond})
+	}
+	return p, s.Err()
+}
+
+// Eval returns the rule that decides the order, or nil when none
+// matches, with the error of a rule that failed.
+func (p *Policy) Eval(env *Env) (*Rule, error) {
+	for i := range p.Rules {
+		if ok, err := p.Rules[i].Matches(env); ok || err != nil {
+			return &p.Rules[i], err
+		}
+	}
+	return nil, nil
+}
+
+// Matches reports whether the condition of the rule holds for the order,
+// or the error that kept it from being computed.
+func (r *Rule) Matches(env *Env) (ok bool, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			e, isEval := v.(evalError)
+			if !isEval {
+				panic(v)
+			}
+			ok, err = false, e.err
+		}
+	}()
+	return r.cond.eval(env).(bool), nil
+}
+
+// Verb is "allows" or "denies".
+func (r *Rule) Verb() string {
+	if r.Allow {
+		return "allows"
+	}
+	return "denies"
+}
+
+// Watch calls reload with the policy file at path whenever it changes,
+// or with the error that kept it from loading, until ctx is done. The
+// file may be created after Watch starts.
+func Watch(ctx context.Context, path string, reload func(*Policy, error)) error {
+	return filewatch.Watch(ctx, path, 200*time.Millisecond, func() {
+		reload(Load(path))
+	})
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range []struct {
+		src  string
+		want string
+	}{
+		{"mode sometimes", "p.rules:1: mode must be enforce or dry-run"},
+		{"# ok\n\nblock x: true", "p.rules:3: want allow|deny <name>: <condition>"},
+		{"deny: true", "p.rules:1: want allow|deny <name>: <condition>"},
+		{"deny a: true\nallow a: false", "p.rules:2: rule a is already on line 1"},
+		{"deny a: ", `p.rules:1: rule a: column 1: unexpected "end of rule"`},
+		{`deny a: side == "sell`, "p.rules:1: rule a: column 9: unterminated string"},
+		{"deny a: amount $ 3", `p.rules:1: rule a: column 8: unexpected '$'`},
+		{"deny a: amount", "p.rules:1: rule a: the condition is a number, not a bool"},
+		{"deny a: colour == 1", `p.rules:1: rule a: column 1: unknown name "colour"`},
+		{`deny a: side == 1`, "p.rules:1: rule a: column 9: == compares a string with a number"},
+		{`deny a: side + 1 > 0`, "p.rules:1: rule a: column 1: + needs a number, not a string"},
+		{"deny a: true < false", "p.rules:1: rule a: column 1: < cannot order bools"},
+		{`deny a: side in ["buy", 1]`, "p.rules:1: rule a: column 17: in needs a list of strings, not a number"},
+		{"deny a: (amount > 1", `p.rules:1: rule a: column 12: want ")", not "end of rule"`},
+		{"deny a: amount > 1 1", `p.rules:1: rule a: column 12: unexpected "1"`},
+		{`deny a: held(1) > 0`, "p.rules:1: rule a: column 6: held needs a string, not a number"},
+	} {
+		_, err := Parse("p.rules", strings.NewReader(tt.src))
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("Parse(%q) error = %v, want %s", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	p, err := Parse("p.rules", strings.NewReader(`# comment
+mode dry-run
+
+  allow treasury: to == "treasury"
+deny big-sells : side == "sell" && amount > 5000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.DryRun || p.Path != "p.rules" || len(p.Rules) != 2 {
+		t.Fatalf("Parse = %+v", p)
+	}
+	for i, want := range []Rule{
+		{Name: "treasury", Allow: true, Condition: `to == "treasury"`, Line: 4},
+		{Name: "big-sells", Allow: false, Condition: `side == "sell" && amount > 5000`, Line: 5},
+	} {
+		got := p.Rules[i]
+		if got.Name != want.Name || got.Allow != want.Allow || got.Condition != want.Condition || got.Line != want.Line {
+			t.Errorf("rule %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	p, err := Parse("p.rules", strings.NewReader(`
+allow treasury: side == "transfer" && to in ["treasury", "operations"]
+deny large-transfers: side == "transfer" && amount > 5000
+deny large-sells: side == "sell" && amount > holding / 2
+deny weekend-buys: side == "buy" && weekday in ["Sat", "Sun"] && cost > 1000
+deny night: hour < 6 && !(account == "ops")
+deny low-cash: side == "buy" && held("USD") - cost < 100
+deny busy: volume + amount >= 10000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	monday := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	saturday := time.Date(2026, 10, 24, 12, 0, 0, 0, time.UTC)
+	holdings := map[string]float64{"IC": 1000, "USD": 10000}
+	for _, tt := range []struct {
+		name string
+		env  Env
+		want string // the deciding rule, or "" when none matches
+	}{
+		{"plain buy", Env{Time: monday, Side: "buy", Asset: "IC", Amount: 10, Price: 2}, ""},
+		{"transfer to treasury", Env{Time: monday, Side: "transfer", Asset: "IC", To: "treasury", Amount: 9000}, "treasury"},
+		{"large transfer", Env{Time: monday, Side: "transfer", Asset: "IC", To: "bob", Amount: 9000}, "large-transfers"},
+		{"small transfer", Env{Time: monday, Side: "transfer", Asset: "IC", To: "bob", Amount: 5000}, ""},
+		{"sell half", Env{Time: monday, Side: "sell", Asset: "IC", Amount: 500}, ""},
+		{"sell more than half", Env{Time: monday, Side: "sell", Asset: "IC", Amount: 501}, "large-sells"},
+		{"weekend buy", Env{Time: saturday, Side: "buy", Asset: "IC", Amount: 100, Price: 20}, "weekend-buys"},
+		{"cheap weekend buy", Env{Time: saturday, Side: "buy", Asset: "IC", Amount: 100, Price: 10}, ""},
+		{"night", Env{Time: monday.Add(-8 * time.Hour), Side: "buy", Asset: "IC", Amount: 1}, "night"},
+		{"night ops", Env{Time: monday.Add(-8 * time.Hour), Account: "ops", Side: "buy", Asset: "IC", Amount: 1}, ""},
+		{"low cash", Env{Time: monday, Side: "buy", Asset: "IC", Amount: 100, Price: 99.5}, "low-cash"},
+		{"busy", Env{Time: monday, Side: "sell", Asset: "IC", Amount: 1, Volume: 9999}, "busy"},
+	} {
+		tt.env.Holdings = holdings
+		got := ""
+		r, err := p.Eval(&tt.env)
+		if r != nil {
+			got = r.Name
+		}
+		if got != tt.want || err != nil {
+			t.Errorf("%s: Eval = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestEvalDivisionByZero(t *testing.T) {
+	p, err := Parse("p.rules", strings.NewReader(`
+allow small: amount / holding < 0.1
+deny all: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{Side: "sell", Asset: "IC", Amount: 5, Holdings: map[string]float64{"IC": 100}}
+	if r, err := p.Eval(&env); r == nil || r.Name != "small" || err != nil {
+		t.Errorf("Eval = %+v, %v; want rule small", r, err)
+	}
+	env.Holdings = map[string]float64{}
+	r, err := p.Eval(&env)
+	if r == nil || r.Name != "small" || err == nil || err.Error() != "column 8: division by zero" {
+		t.Errorf("Eval with no holding = %+v, %v; want rule small, column 8: division by zero", r, err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.rules")
+	if _, err := Load(path); !os.IsNotExist(err) {
+		t.Errorf("Load of a missing file: error = %v, want not exist", err)
+	}
+	if err := os.WriteFile(path, []byte("deny all: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(path)
+	if err != nil || len(p.Rules) != 1 || p.Rules[0].Verb() != "denies" {
+		t.Errorf("Load = %+v, %v", p, err)
+	}
+}
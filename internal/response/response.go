@@ -0,0 +1,224 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+// Package response acts on enclave tampering reported by the sgx package.
+package response
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/config"
+	"github.com/donaldww/idemo2/internal/sgx"
+)
+
+// Policy selects the actions taken when the enclave is tampered with.
+// An empty directory or file name disables the matching action.
+type Policy struct {
+	HaltTrading   bool   // refuse trades in tcp.Server
+	HaltBlocks    bool   // refuse to produce blocks
+	QuarantineDir string // move rogue items here
+	TrustedDir    string // restore modified and removed files from here
+	IncidentLog   string // append an incident entry here
+}
+
+// PolicyFromConfig reads the tamper* keys from the config file.
+func PolicyFromConfig(cf *config.Config) Policy {
+	s := cf.Settings()
+	p := Policy{
+		HaltTrading: s.TamperHaltTrading,
+		HaltBlocks:  s.TamperHaltBlocks,
+	}
+	if s.TamperQuarantine {
+		p.QuarantineDir = s.QuarantineDir
+	}
+	if s.TamperRestore {
+		p.TrustedDir = s.TrustedDir
+	}
+	if s.TamperIncidents {
+		p.IncidentLog = s.IncidentLog
+	}
+	return p
+}
+
+// Responder applies a Policy to the discrepancies found in one enclave.
+// It is safe for concurrent use.
+type Responder struct {
+	root   string
+	policy Policy
+
+	mu       sync.Mutex
+	tampered bool
+	last     string // the changes most recently acted on
+}
+
+// New returns a Responder for the enclave rooted at root.
+func New(root string, p Policy) *Responder {
+	return &Responder{root: root, policy: p}
+}
+
+// TradingHalted reports whether trades must be refused.
+func (r *Responder) TradingHalted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tampered && r.policy.HaltTrading
+}
+
+// BlocksHalted reports whether block production must stop.
+func (r *Responder) BlocksHalted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tampered && r.policy.HaltBlocks
+}
+
+// incident is one entry in the incident log.
+type incident struct {
+	Time    string       `json:"time"`
+	Changes []sgx.Change `json:"changes"`
+	Actions []string     `json:"actions"`
+}
+
+// Handle applies the policy to the latest set of changes and returns a
+// description of every action taken. Changes identical to the previous
+// call are not acted on again. An empty set of changes lifts any halt
+// that is in force.
+func (r *Responder) Handle(changes []sgx.Change) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(changes) == 0 {
+		r.last = ""
+		if r.tampered {
+			r.tampered = false
+			return []string{"SGX RESPONSE: enclave verified, halts lifted."}
+		}
+		return nil
+	}
+	key := fmt.Sprint(changes)
+	if key == r.last {
+		return nil
+	}
+	r.last = key
+	var actions []string
+	if !r.tampered {
+		r.tampered = true
+		if r.policy.HaltTrading {
+			actions = append(actions, "SGX RESPONSE: trading halted.")
+		}
+		if r.policy.HaltBlocks {
+			actions = append(actions, "SGX RESPONSE: block production halted.")
+		}
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	for _, c := range changes {
+		var err error
+		var action string
+		switch {
+		case c.Kind == sgx.Added && r.policy.QuarantineDir != "":
+			action, err = r.quarantine(c, stamp)
+		case c.Kind != sgx.Added && r.policy.TrustedDir != "":
+			action, err = r.restore(c)
+		}
+		if err != nil {
+			action = fmt.Sprintf("SGX RESPONSE: %s: %v", c.Path, err)
+		}
+		if action != "" {
+			actions = append(actions, action)
+		}
+	}
+	if r.policy.IncidentLog != "" {
+		if err := r.record(changes, actions); err != nil {
+			actions = append(actions, fmt.Sprintf("SGX RESPONSE: incident log: %v", err))
+		}
+	}
+	return actions
+}
+
+// quarantine moves a rogue item out of the enclave.
+func (r *Responder) quarantine(c sgx.Change, stamp string) (string, error) {
+	src := filepath.Join(r.root, filepath.FromSlash(c.Path))
+	dst := filepath.Join(r.policy.QuarantineDir, stamp, filepath.FromSlash(c.Path))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return "", err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		if os.IsNotExist(err) {
+			// Already moved along with its parent directory.
+			return "", nil
+		}
+		return "", err
+	}
+	return fmt.Sprintf("SGX RESPONSE: quarantined %s to %s", c.Path, dst), nil
+}
+
+// restore puts a modified or removed item back the way the baseline
+// recorded it.
+func (r *Responder) restore(c sgx.Change) (string, error) {
+	dst := filepath.Join(r.root, filepath.FromSlash(c.Path))
+	switch {
+	case c.Type == "d" && c.Kind == sgx.Removed:
+		if err := os.MkdirAll(dst, c.OldMode.Perm()); err != nil {
+			return "", err
+		}
+	case c.Type == "f" && c.Kind != sgx.Permissions:
+		src := filepath.Join(r.policy.TrustedDir, filepath.FromSlash(c.Path))
+		if err := copyTrusted(src, dst, c.OldHash); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Chmod(dst, c.OldMode.Perm()); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("SGX RESPONSE: restored %s", c.Path), nil
+}
+
+// copyTrusted copies src over dst after checking that src still matches
+// the baseline hash.
+func copyTrusted(src, dst, hash string) error {
+	sum, err := sgx.HashFile(src)
+	if err != nil {
+		return err
+	}
+	if sum != hash {
+		return fmt.Errorf("trusted copy %s does not match the baseline", src)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".restore"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// record appends an incident entry to the incident log.
+func (r *Responder) record(changes []sgx.Change, actions []string) error {
+	f, err := os.OpenFile(r.policy.IncidentLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(incident{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Changes: changes,
+		Actions: actions,
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/donaldww/idemo2/internal/sgx"
+)
+
+func writeFile(t *testing.T, path, data string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func hash(t *testing.T, path string) string {
+	t.Helper()
+	sum, err := sgx.HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+func TestHalts(t *testing.T) {
+	r := New(t.TempDir(), Policy{HaltTrading: true})
+	if r.TradingHalted() || r.BlocksHalted() {
+		t.Fatal("halted before any change")
+	}
+	changes := []sgx.Change{{Kind: sgx.Permissions, Path: "app", Type: "f"}}
+	got := r.Handle(changes)
+	if len(got) != 1 || got[0] != "SGX RESPONSE: trading halted." {
+		t.Errorf("Handle = %q, want trading halted", got)
+	}
+	if !r.TradingHalted() || r.BlocksHalted() {
+		t.Errorf("TradingHalted, BlocksHalted = %v, %v; want true, false", r.TradingHalted(), r.BlocksHalted())
+	}
+	if got := r.Handle(changes); got != nil {
+		t.Errorf("Handle of the same changes = %q, want nothing", got)
+	}
+	got = r.Handle(nil)
+	if len(got) != 1 || got[0] != "SGX RESPONSE: enclave verified, halts lifted." {
+		t.Errorf("Handle(nil) = %q, want halts lifted", got)
+	}
+	if r.TradingHalted() {
+		t.Error("trading still halted after the enclave verified")
+	}
+	if got := r.Handle(nil); got != nil {
+		t.Errorf("Handle(nil) again = %q, want nothing", got)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	root, qdir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(root, "lib", "rogue.so"), "rogue", 0o644)
+	r := New(root, Policy{QuarantineDir: qdir})
+	got := r.Handle([]sgx.Change{{Kind: sgx.Added, Path: "lib/rogue.so", Type: "f"}})
+	if len(got) != 1 || !strings.HasPrefix(got[0], "SGX RESPONSE: quarantined lib/rogue.so to "+qdir) {
+		t.Fatalf("Handle = %q, want the rogue file quarantined", got)
+	}
+	if _, err := os.Stat(filepath.Join(root, "lib", "rogue.so")); !os.IsNotExist(err) {
+		t.Errorf("rogue file still in the enclave: %v", err)
+	}
+	moved, _ := filepath.Glob(filepath.Join(qdir, "*", "lib", "rogue.so"))
+	if len(moved) != 1 {
+		t.Errorf("quarantine holds %q, want the rogue file", moved)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	root, trusted := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(trusted, "app"), "good", 0o755)
+	good := hash(t, filepath.Join(trusted, "app"))
+	writeFile(t, filepath.Join(root, "app"), "bad", 0o644)
+	r := New(root, Policy{TrustedDir: trusted})
+
+	got := r.Handle([]sgx.Change{
+		{Kind: sgx.Modified, Path: "app", Type: "f", OldHash: good, OldMode: 0o755},
+		{Kind: sgx.Removed, Path: "lib", Type: "d", OldMode: 0o750},
+	})
+	want := []string{"SGX RESPONSE: restored app", "SGX RESPONSE: restored lib"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Handle = %q, want %q", got, want)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "app")); string(data) != "good" {
+		t.Errorf("restored app holds %q, want good", data)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "app")); err != nil || fi.Mode().Perm() != 0o755 {
+		t.Errorf("restored app mode = %v, %v; want 0755", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "lib")); err != nil || !fi.IsDir() {
+		t.Errorf("lib not restored: %v", err)
+	}
+
+	// A trusted copy that no longer matches the baseline is not used.
+	writeFile(t, filepath.Join(trusted, "app"), "changed", 0o755)
+	writeFile(t, filepath.Join(root, "app"), "bad", 0o644)
+	got = r.Handle([]sgx.Change{{Kind: sgx.Modified, Path: "app", Type: "f", OldHash: good, OldMode: 0o755}})
+	if len(got) != 1 || !strings.Contains(got[0], "does not match the baseline") {
+		t.Errorf("Handle with a changed trusted copy = %q, want a mismatch", got)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "app")); string(data) != "bad" {
+		t.Errorf("app holds %q after a refused restore, want bad", data)
+	}
+}
+
+func TestIncidentLog(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "incidents.log")
+	r := New(t.TempDir(), Policy{HaltBlocks: true, IncidentLog: log})
+	r.Handle([]sgx.Change{{Kind: sgx.Permissions, Path: "app", Type: "f"}})
+	r.Handle([]sgx.Change{{Kind: sgx.Permissions, Path: "lib", Type: "d"}})
+
+	f, err := os.Open(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []incident
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var in incident
+		if err := json.Unmarshal(s.Bytes(), &in); err != nil {
+			t.Fatalf("%s: %v", s.Text(), err)
+		}
+		got = append(got, in)
+	}
+	if len(got) != 2 {
+		t.Fatalf("incident log holds %d entries, want 2", len(got))
+	}
+	if got[0].Changes[0].Path != "app" || len(got[0].Actions) != 1 ||
+		got[0].Actions[0] != "SGX RESPONSE: block production halted." {
+		t.Errorf("first incident = %+v", got[0])
+	}
+	if got[1].Changes[0].Path != "lib" || len(got[1].Actions) != 0 {
+		t.Errorf("second incident = %+v, want no action, since blocks are halted already", got[1])
+	}
+}
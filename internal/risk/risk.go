@@ -0,0 +1,337 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+// Package risk checks orders against trading limits and the rules of a
+// policy file before they are executed and reach consensus.
+package risk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/config"
+	"github.com/donaldww/idemo2/internal/money"
+	"github.com/donaldww/idemo2/internal/policy"
+)
+
+// Limits selects the risk rules applied to each order. A zero limit, or
+// an empty blacklist, disables its rule.
+type Limits struct {
+	MaxOrder    money.Amount  // largest amount of one order
+	DailyVolume money.Amount  // largest amount of an asset an account trades in a day
+	Rate        int           // most orders of an account in RateWindow
+	RateWindow  time.Duration // one second when zero
+	Blacklist   []string      // accounts that may not trade or receive transfers
+	MaxHolding  money.Amount  // largest holding a buy may leave
+}
+
+// LimitsFromConfig reads the risk* keys from the config file.
+func LimitsFromConfig(cf *config.Config) Limits {
+	s := cf.Settings()
+	return Limits{
+		MaxOrder:    s.RiskMaxOrder,
+		DailyVolume: s.RiskDailyVolume,
+		Rate:        s.RiskRate,
+		RateWindow:  s.RiskRateWindow,
+		Blacklist:   s.RiskBlacklist,
+		MaxHolding:  s.RiskMaxHolding,
+	}
+}
+
+// Order is an order to check.
+type Order struct {
+	Time     time.Time
+	Account  string
+	Side     string // buy, sell or transfer
+	Asset    string
+	Amount   money.Amount
+	Price    money.Amount            // in the quote asset; 0 for an order without a price
+	Holdings map[string]money.Amount // of the account, before the order
+	To       string                  // account credited by a transfer
+}
+
+// Rejection is the refusal of an order by a rule.
+type Rejection struct {
+	Rule   string
+	Reason string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("%s (%s)", r.Reason, r.Rule)
+}
+
+// rules are applied in turn. Each returns why it refuses the order, or ""
+// to pass it on.
+var rules = []struct {
+	name  string
+	check func(e *Engine, o Order) string
+}{
+	{"rate", (*Engine).rate},
+	{"blacklist", (*Engine).blacklist},
+	{"maxOrder", (*Engine).maxOrder},
+	{"dailyVolume", (*Engine).dailyVolume},
+	{"overflow", (*Engine).overflow},
+}
+
+// Engine applies Limits, then a Policy, to orders. It counts the orders
+// and the volume of each account. It is safe for concurrent use.
+type Engine struct {
+	limits Limits
+	log    *slog.Logger
+
+	mu     sync.Mutex
+	policy *policy.Policy
+	recent map[string][]time.Time  // times of the orders in the rate window, by account
+	volume map[string]money.Amount // traded today, by account and asset
+	day    string                  // of the volume
+}
+
+// New returns an Engine applying l. The decisions of a policy in dry run
+// are logged to log.
+func New(l Limits, log *slog.Logger) *Engine {
+	if l.RateWindow <= 0 {
+		l.RateWindow = time.Second
+	}
+	return &Engine{limits: l, log: log, recent: map[string][]time.Time{}, volume: map[string]money.Amount{}}
+}
+
+// SetPolicy replaces the policy applied after the limits; nil removes
+// it.
+func (e *Engine) SetPolicy(p *policy.Policy) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.policy = p
+}
+
+// WatchPolicy loads the policy file at path, and loads it again whenever
+// it changes, until ctx is done. When the file does not load, the error is
+// logged and the policy before it is kept; without a file, there is no
+// policy.
+func (e *Engine) WatchPolicy(ctx context.Context, path string) {
+	e.reload(policy.Load(path))
+	if err := policy.Watch(ctx, path, e.reload); err != nil {
+		e.log.Error("Policy watch failed; changes to the policy file are ignored.", "err", err)
+	}
+}
+
+func (e *Engine) reload(p *policy.Policy, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		e.SetPolicy(nil)
+		e.log.Info("No policy file.", "err", err)
+	case err != nil:
+		e.log.Warn(fmt.Sprintf("POLICY NOT LOADED: %v; the policy before it is kept.", err), "err", err)
+	default:
+		e.SetPolicy(p)
+		mode := "enforce"
+		if p.DryRun {
+			mode = "dry-run"
+		}
+		e.log.Info(fmt.Sprintf("Policy loaded: %d rules, mode %s.", len(p.Rules), mode), "path", p.Path,
+			"rules", len(p.Rules), "mode", mode)
+	}
+}
+
+// Check applies the rules to the order and returns the first Rejection,
+// or nil. Every order checked counts towards the rate of its account.
+// A policy in dry run logs its decision and refuses nothing.
+func (e *Engine) Check(o Order) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.limits.Rate > 0 {
+		defer func() { e.recent[o.Account] = append(e.recent[o.Account], o.Time) }()
+	}
+	for _, r := range rules {
+		if reason := r.check(e, o); reason != "" {
+			return &Rejection{Rule: r.name, Reason: reason}
+		}
+	}
+	if e.policy == nil {
+		return nil
+	}
+	r, err := e.policy.Eval(e.env(o))
+	if e.policy.DryRun {
+		decision, rule := "allowed: no rule matched.", ""
+		switch {
+		case err != nil:
+			decision, rule = "refused by rule "+r.Name+", which fails: "+err.Error()+".", r.Name
+		case r != nil && r.Allow:
+			decision, rule = "allowed by rule "+r.Name+".", r.Name
+		case r != nil:
+			decision, rule = "denied by rule "+r.Name+".", r.Name
+		}
+		e.log.Info("policy dry run: "+o.Side+" order "+decision, "account", o.Account, "side", o.Side,
+			"asset", o.Asset, "amount", o.Amount.String(), "rule", rule)
+		return nil
+	}
+	return policyRejection(r, err)
+}
+
+// policyRejection is the refusal by the policy rule r that decided an
+// order, or nil when it allows the order. A rule that fails refuses it.
+func policyRejection(r *policy.Rule, err error) error {
+	switch {
+	case err != nil:
+		return &Rejection{Rule: "policy:" + r.Name, Reason: "the rule fails: " + err.Error()}
+	case r != nil && !r.Allow:
+		return &Rejection{Rule: "policy:" + r.Name, Reason: "denied by the policy"}
+	}
+	return nil
+}
+
+// Step is the outcome of one rule in an explanation.
+type Step struct {
+	Rule   string
+	Result string
+}
+
+// Explain applies every rule to the order, without counting it, and
+// returns the outcome of each with the error Check would return.
+func (e *Engine) Explain(o Order) ([]Step, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var (
+		steps   []Step
+		refused error
+	)
+	for _, r := range rules {
+		result := "passes"
+		if reason := r.check(e, o); reason != "" {
+			result = "refuses: " + reason
+			if refused == nil {
+				refused = &Rejection{Rule: r.name, Reason: reason}
+			}
+		}
+		steps = append(steps, Step{r.name, result})
+	}
+	if e.policy == nil {
+		return steps, refused
+	}
+	env, decided := e.env(o), false
+	for i := range e.policy.Rules {
+		r := &e.policy.Rules[i]
+		ok, err := r.Matches(env)
+		result := "no match"
+		switch {
+		case decided && err != nil:
+			result = "fails, not reached"
+		case decided && ok:
+			result = "matches, not reached"
+		case decided:
+		case ok || err != nil:
+			decided, result = true, r.Verb()
+			if err != nil {
+				result = "fails: " + err.Error()
+			}
+			if e.policy.DryRun {
+				result += " (dry run)"
+			} else if refused == nil {
+				refused = policyRejection(r, err)
+			}
+		}
+		steps = append(steps, Step{"policy:" + r.Name, result})
+	}
+	return steps, refused
+}
+
+// env is what the policy sees of the order.
+func (e *Engine) env(o Order) *policy.Env {
+	e.newDay(o.Time)
+	env := &policy.Env{Time: o.Time, Account: o.Account, Side: o.Side, Asset: o.Asset, To: o.To,
+		Amount: o.Amount.Float64(), Price: o.Price.Float64(), Volume: e.volume[o.Account+" "+o.Asset].Float64(),
+		Holdings: map[string]float64{}}
+	for a, v := range o.Holdings {
+		env.Holdings[a] = v.Float64()
+	}
+	return env
+}
+
+// Executed counts an executed order towards the daily volume of its
+// account.
+func (e *Engine) Executed(o Order) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.newDay(o.Time)
+	key := o.Account + " " + o.Asset
+	if v, err := e.volume[key].Add(o.Amount); err == nil {
+		e.volume[key] = v
+	}
+}
+
+func (e *Engine) blacklist(o Order) string {
+	switch {
+	case slices.Contains(e.limits.Blacklist, o.Account):
+		return "account " + o.Account + " is blacklisted"
+	case o.To != "" && slices.Contains(e.limits.Blacklist, o.To):
+		return "account " + o.To + " is blacklisted"
+	}
+	return ""
+}
+
+func (e *Engine) rate(o Order) string {
+	if e.limits.Rate == 0 {
+		return ""
+	}
+	times := e.recent[o.Account]
+	for len(times) > 0 && o.Time.Sub(times[0]) >= e.limits.RateWindow {
+		times = times[1:]
+	}
+	e.recent[o.Account] = times
+	if len(times) >= e.limits.Rate {
+		return fmt.Sprintf("more than %d orders in %v", e.limits.Rate, e.limits.RateWindow)
+	}
+	return ""
+}
+
+func (e *Engine) maxOrder(o Order) string {
+	if e.limits.MaxOrder > 0 && o.Amount > e.limits.MaxOrder {
+		return fmt.Sprintf("order above the limit of %s %s", e.limits.MaxOrder, o.Asset)
+	}
+	return ""
+}
+
+func (e *Engine) dailyVolume(o Order) string {
+	if e.limits.DailyVolume == 0 {
+		return ""
+	}
+	e.newDay(o.Time)
+	v, err := e.volume[o.Account+" "+o.Asset].Add(o.Amount)
+	if err != nil || v > e.limits.DailyVolume {
+		return fmt.Sprintf("daily volume above the limit of %s %s", e.limits.DailyVolume, o.Asset)
+	}
+	return ""
+}
+
+// overflow refuses a buy whose holding or cost would not fit in an
+// Amount, or whose holding would pass MaxHolding.
+func (e *Engine) overflow(o Order) string {
+	if o.Side != "buy" {
+		return ""
+	}
+	h, err := o.Holdings[o.Asset].Add(o.Amount)
+	if err == nil && o.Price > 0 {
+		_, err = o.Amount.MulUp(o.Price)
+	}
+	switch {
+	case err != nil:
+		return "amount too large"
+	case e.limits.MaxHolding > 0 && h > e.limits.MaxHolding:
+		return fmt.Sprintf("holding above the limit of %s %s", e.limits.MaxHolding, o.Asset)
+	}
+	return ""
+}
+
+// newDay clears the volume when the day of t has begun.
+func (e *Engine) newDay(t time.Time) {
+	if d := t.Format("2006-01-02"); d != e.day {
+		e.day = d
+		clear(e.volume)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package risk
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/money"
+	"github.com/donaldww/idemo2/internal/policy"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func mustPolicy(t *testing.T, src string) *policy.Policy {
+	t.Helper()
+	p, err := policy.Parse("p.rules", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPolicyDivisionByZero(t *testing.T) {
+	e := New(Limits{}, quiet)
+	e.SetPolicy(mustPolicy(t, "allow small: amount / holding < 0.1\ndeny other: side == \"sell\""))
+	o := Order{Time: time.Now(), Account: "a", Side: "sell", Asset: "IC", Amount: 500,
+		Holdings: map[string]money.Amount{}}
+	err := e.Check(o)
+	var rej *Rejection
+	if !errors.As(err, &rej) || rej.Rule != "policy:small" {
+		t.Fatalf("Check = %v, want a refusal by policy:small", err)
+	}
+	if want := "the rule fails: column 8: division by zero (policy:small)"; err.Error() != want {
+		t.Errorf("Check = %q, want %q", err, want)
+	}
+	steps, err := e.Explain(o)
+	if !errors.As(err, &rej) || rej.Rule != "policy:small" {
+		t.Errorf("Explain error = %v, want a refusal by policy:small", err)
+	}
+	want := []Step{
+		{"policy:small", "fails: column 8: division by zero"},
+		{"policy:other", "matches, not reached"},
+	}
+	if got := steps[len(steps)-len(want):]; !slices.Equal(got, want) {
+		t.Errorf("Explain steps = %v, want them to end with %v", steps, want)
+	}
+}
+
+// ruleOf names the rule that refused the order, or "" when none did.
+func ruleOf(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	var rej *Rejection
+	if !errors.As(err, &rej) {
+		t.Fatalf("error %v is not a Rejection", err)
+	}
+	return rej.Rule
+}
+
+func TestLimits(t *testing.T) {
+	noon := time.Date(2019, 10, 19, 12, 0, 0, 0, time.UTC)
+	buy := func(amount money.Amount) Order {
+		return Order{Time: noon, Account: "a", Side: "buy", Asset: "IC", Amount: amount, Price: 100,
+			Holdings: map[string]money.Amount{"IC": 1000}}
+	}
+	transfer := Order{Time: noon, Account: "a", Side: "transfer", Asset: "IC", Amount: 100, To: "eve"}
+	for _, tt := range []struct {
+		name  string
+		l     Limits
+		o     Order
+		want  string // the rule that refuses the order
+		error string
+	}{
+		{"no limits", Limits{}, buy(1 << 40), "", ""},
+		{"blacklisted account", Limits{Blacklist: []string{"a"}}, buy(100), "blacklist",
+			"account a is blacklisted (blacklist)"},
+		{"blacklisted payee", Limits{Blacklist: []string{"eve"}}, transfer, "blacklist",
+			"account eve is blacklisted (blacklist)"},
+		{"order at the limit", Limits{MaxOrder: 100}, buy(100), "", ""},
+		{"order above the limit", Limits{MaxOrder: 100}, buy(101), "maxOrder",
+			"order above the limit of 1.00 IC (maxOrder)"},
+		{"volume above the limit", Limits{DailyVolume: 100}, buy(101), "dailyVolume",
+			"daily volume above the limit of 1.00 IC (dailyVolume)"},
+		{"holding at the limit", Limits{MaxHolding: 1100}, buy(100), "", ""},
+		{"holding above the limit", Limits{MaxHolding: 1100}, buy(101), "overflow",
+			"holding above the limit of 11.00 IC (overflow)"},
+		{"holding overflow", Limits{}, buy(math.MaxInt64 - 999), "overflow", "amount too large (overflow)"},
+		{"cost overflow", Limits{}, Order{Time: noon, Account: "a", Side: "buy", Asset: "IC",
+			Amount: math.MaxInt64 / 2, Price: 300}, "overflow", "amount too large (overflow)"},
+		{"sell of a large holding", Limits{MaxHolding: 1}, Order{Time: noon, Account: "a", Side: "sell",
+			Asset: "IC", Amount: 100, Holdings: map[string]money.Amount{"IC": 1000}}, "", ""},
+		{"first rule to refuse", Limits{MaxOrder: 100, Blacklist: []string{"a"}}, buy(101), "blacklist",
+			"account a is blacklisted (blacklist)"},
+	} {
+		err := New(tt.l, quiet).Check(tt.o)
+		if got := ruleOf(t, err); got != tt.want || (err != nil && err.Error() != tt.error) {
+			t.Errorf("%s: Check = %v, want %q", tt.name, err, tt.error)
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	e := New(Limits{Rate: 2, RateWindow: time.Second}, quiet)
+	t0 := time.Date(2019, 10, 19, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		account string
+		after   time.Duration
+		want    string
+	}{
+		{"a", 0, ""},
+		{"a", 100 * time.Millisecond, ""},
+		{"a", 200 * time.Millisecond, "rate"},
+		{"b", 200 * time.Millisecond, ""}, // each account has its own rate
+		// The refused order counts too, so one slot is free a second
+		// after the second order.
+		{"a", 1100 * time.Millisecond, ""},
+		{"a", 1150 * time.Millisecond, "rate"},
+	} {
+		o := Order{Time: t0.Add(tt.after), Account: tt.account, Side: "sell", Asset: "IC", Amount: 1}
+		if got := ruleOf(t, e.Check(o)); got != tt.want {
+			t.Errorf("%s at %v: refused by %q, want %q", tt.account, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestDailyVolume(t *testing.T) {
+	e := New(Limits{DailyVolume: 10000}, quiet)
+	day := time.Date(2019, 10, 19, 9, 0, 0, 0, time.UTC)
+	order := func(at time.Time, account string, amount money.Amount) Order {
+		return Order{Time: at, Account: account, Side: "sell", Asset: "IC", Amount: amount}
+	}
+	e.Executed(order(day, "a", 6000))
+	for _, tt := range []struct {
+		o    Order
+		want string
+	}{
+		{order(day.Add(time.Hour), "a", 5000), "dailyVolume"},
+		{order(day.Add(time.Hour), "a", 4000), ""},
+		{order(day.Add(time.Hour), "b", 10000), ""},
+		{order(day.Add(24*time.Hour), "a", 10000), ""}, // a new day
+	} {
+		if got := ruleOf(t, e.Check(tt.o)); got != tt.want {
+			t.Errorf("%s %s at %v: refused by %q, want %q", tt.o.Account, tt.o.Amount, tt.o.Time, got, tt.want)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	e := New(Limits{Rate: 1, MaxOrder: 100}, quiet)
+	e.SetPolicy(mustPolicy(t, "deny sells: side == \"sell\""))
+	o := Order{Time: time.Now(), Account: "a", Side: "sell", Asset: "IC", Amount: 500}
+	for i := 0; i < 2; i++ { // explain does not count towards the rate
+		steps, err := e.Explain(o)
+		want := []Step{
+			{"rate", "passes"},
+			{"blacklist", "passes"},
+			{"maxOrder", "refuses: order above the limit of 1.00 IC"},
+			{"dailyVolume", "passes"},
+			{"overflow", "passes"},
+			{"policy:sells", "denies"},
+		}
+		if !slices.Equal(steps, want) {
+			t.Errorf("Explain steps = %v, want %v", steps, want)
+		}
+		if ruleOf(t, err) != "maxOrder" {
+			t.Errorf("Explain error = %v, want the maxOrder refusal", err)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	o := Order{Time: time.Now(), Account: "a", Side: "sell", Asset: "IC", Amount: 5000}
+	e := New(Limits{}, quiet)
+	e.SetPolicy(mustPolicy(t, "allow small: amount < 10\ndeny sells: side == \"sell\""))
+	if got := ruleOf(t, e.Check(o)); got != "policy:sells" {
+		t.Errorf("Check refused by %q, want policy:sells", got)
+	}
+	o.Amount = 900
+	if err := e.Check(o); err != nil {
+		t.Errorf("Check of an allowed order = %v", err)
+	}
+	e.SetPolicy(mustPolicy(t, "mode dry-run\ndeny sells: side == \"sell\""))
+	if err := e.Check(o); err != nil {
+		t.Errorf("Check in dry run = %v, want nil", err)
+	}
+	e.SetPolicy(nil)
+	if err := e.Check(o); err != nil {
+		t.Errorf("Check without a policy = %v, want nil", err)
+	}
+}
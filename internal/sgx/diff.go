@@ -0,0 +1,113 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package sgx
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// ChangeKind classifies a difference between the baseline and a scan.
+type ChangeKind string
+
+const (
+	Added       ChangeKind = "added"
+	Removed     ChangeKind = "removed"
+	Modified    ChangeKind = "modified"
+	Permissions ChangeKind = "permissions"
+)
+
+// Change describes one discrepancy between the baseline and the enclave.
+// Old fields come from the baseline and New fields from the latest scan.
+type Change struct {
+	Kind    ChangeKind  `json:"kind"`
+	Path    string      `json:"path"`
+	Type    string      `json:"type"`
+	OldHash string      `json:"oldHash,omitempty"`
+	NewHash string      `json:"newHash,omitempty"`
+	OldSize int64       `json:"oldSize,omitempty"`
+	NewSize int64       `json:"newSize,omitempty"`
+	OldMode os.FileMode `json:"oldMode,omitempty"`
+	NewMode os.FileMode `json:"newMode,omitempty"`
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case Added:
+		return fmt.Sprintf("SGX SIMULATOR ENCLAVE: rogue item added: %s (sha256 %s)",
+			c.Path, short(c.NewHash))
+	case Removed:
+		return fmt.Sprintf("SGX SIMULATOR ENCLAVE: item removed: %s (sha256 %s)",
+			c.Path, short(c.OldHash))
+	case Modified:
+		return fmt.Sprintf("SGX SIMULATOR ENCLAVE: %s chksum failed: %s -> %s",
+			c.Path, short(c.OldHash), short(c.NewHash))
+	case Permissions:
+		return fmt.Sprintf("SGX SIMULATOR ENCLAVE: %s permissions changed: %s -> %s",
+			c.Path, c.OldMode, c.NewMode)
+	}
+	return fmt.Sprintf("SGX SIMULATOR ENCLAVE: %s %s", c.Path, c.Kind)
+}
+
+// short abbreviates a hex hash for display.
+func short(hash string) string {
+	if hash == "" {
+		return "-"
+	}
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// Diff compares the latest scan with the baseline and returns every
+// discrepancy, ordered by path.
+func (e *Enclave) Diff() []Change {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return diffEnclaves(e.stable, e.scanned)
+}
+
+// DiffManifests returns every discrepancy between two manifests, with old
+// as the baseline.
+func DiffManifests(old, cur *Manifest) []Change {
+	return diffEnclaves(old.enclave(), cur.enclave())
+}
+
+func diffEnclaves(stable, scanned enclaveMap) []Change {
+	var changes []Change
+	for k, old := range stable {
+		cur, ok := scanned[k]
+		if !ok {
+			changes = append(changes, Change{Kind: Removed, Path: k, Type: old.Type,
+				OldHash: old.ShaSum, OldSize: old.Size, OldMode: old.Mode})
+			continue
+		}
+		if cur.Type != old.Type || cur.ShaSum != old.ShaSum || cur.Size != old.Size {
+			changes = append(changes, Change{Kind: Modified, Path: k, Type: cur.Type,
+				OldHash: old.ShaSum, NewHash: cur.ShaSum, OldSize: old.Size, NewSize: cur.Size,
+				OldMode: old.Mode, NewMode: cur.Mode})
+			continue
+		}
+		if cur.Mode != old.Mode {
+			changes = append(changes, Change{Kind: Permissions, Path: k, Type: cur.Type,
+				OldHash: old.ShaSum, NewHash: cur.ShaSum, OldMode: old.Mode, NewMode: cur.Mode})
+		}
+	}
+	for k, cur := range scanned {
+		if _, ok := stable[k]; !ok {
+			changes = append(changes, Change{Kind: Added, Path: k, Type: cur.Type,
+				NewHash: cur.ShaSum, NewSize: cur.Size, NewMode: cur.Mode})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Path == changes[j].Path {
+			return changes[i].Kind < changes[j].Kind
+		}
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
@@ -0,0 +1,186 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package sgx
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// ManifestEntry records the trusted state of one item in the enclave.
+type ManifestEntry struct {
+	Path   string      `json:"path"`
+	Type   string      `json:"type"`
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256,omitempty"`
+}
+
+// Manifest is a signed list of every item in a trusted enclave.
+type Manifest struct {
+	Created   string          `json:"created"`
+	Entries   []ManifestEntry `json:"entries"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// NewManifest scans root and returns an unsigned manifest of its contents.
+func NewManifest(root string) (*Manifest, error) {
+	em, list, err := scanDir(root)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{Created: time.Now().UTC().Format(time.RFC3339)}
+	for _, k := range list {
+		x := em[k]
+		m.Entries = append(m.Entries,
+			ManifestEntry{Path: x.Path, Type: x.Type, Size: x.Size, Mode: x.Mode, SHA256: x.ShaSum})
+	}
+	return m, nil
+}
+
+// payload returns the bytes covered by the signature.
+func (m *Manifest) payload() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = ""
+	return json.Marshal(unsigned)
+}
+
+// Sign signs the manifest with the operator's private key.
+func (m *Manifest) Sign(key ed25519.PrivateKey) error {
+	p, err := m.payload()
+	if err != nil {
+		return err
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, p))
+	return nil
+}
+
+// Verify checks the manifest signature against the operator's public key.
+func (m *Manifest) Verify(key ed25519.PublicKey) error {
+	if m.Signature == "" {
+		return errors.New("sgx: manifest is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("sgx: bad manifest signature: %w", err)
+	}
+	p, err := m.payload()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, p, sig) {
+		return errors.New("sgx: manifest signature verification failed")
+	}
+	return nil
+}
+
+// enclave converts the manifest into the form used by IsValid.
+func (m *Manifest) enclave() enclaveMap {
+	em := enclaveMap{}
+	for _, e := range m.Entries {
+		em[e.Path] = enclaveItem{Name: path.Base(e.Path), Path: e.Path, Type: e.Type,
+			Size: e.Size, Mode: e.Mode, ShaSum: e.SHA256}
+	}
+	return em
+}
+
+// WriteManifest writes the manifest to path as indented JSON.
+func (m *Manifest) WriteManifest(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// ReadManifest reads a manifest written by WriteManifest.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("sgx: %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// GenerateKey creates a new operator key pair and writes it to privPath
+// and pubPath in PEM format.
+func GenerateKey(privPath, pubPath string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0o600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o644)
+}
+
+// LoadPrivateKey reads an operator private key written by GenerateKey.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("sgx: %s: %w", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("sgx: %s: not an ed25519 key", path)
+	}
+	return priv, nil
+}
+
+// LoadPublicKey reads an operator public key written by GenerateKey.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("sgx: %s: %w", path, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("sgx: %s: not an ed25519 key", path)
+	}
+	return pub, nil
+}
+
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("sgx: %s: no %s block found", path, blockType)
+	}
+	return block.Bytes, nil
+}
@@ -2,164 +2,248 @@
 // Use of this source code is governed by an MIT
 // license that can be found in the LICENSE file.
 
+// Package sgx simulates the integrity checks of an SGX enclave by comparing
+// a directory tree against a signed baseline manifest.
 package sgx
 
 import (
-	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"github.com/donaldww/idemo2/internal/config"
-	"log"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // EnclaveItem represents an artifact in the enclave.
 type enclaveItem struct {
 	Name   string
-	Path   string
+	Path   string // relative to the enclave root
 	Type   string
-	Md5    string
+	Size   int64
+	Mode   os.FileMode
 	ShaSum string
 }
 
 type enclaveMap map[string]enclaveItem
 
-// This is the enclave that is scanned every time.
-var scannedEnclave = enclaveMap{}
-var scannedList []string = nil
+// Enclave monitors one directory tree. It is safe for concurrent use, so
+// several enclaves (e.g. one per simulated node) can be monitored at once.
+type Enclave struct {
+	root     string
+	debounce time.Duration
+	rescan   time.Duration
+	observe  func(time.Duration)
+	requests chan struct{}
+
+	mu sync.RWMutex
+	// The trusted enclave, loaded from the signed baseline manifest.
+	stable enclaveMap
+	// The enclave as of the latest scan.
+	scanned enclaveMap
+}
 
-// This is a copy of the first scanned enclave.
-var stableEnclave = enclaveMap{}
-var stableList []string = nil
+// Option configures an Enclave.
+type Option func(*Enclave)
 
-// println prints an enclave item.
-func (e enclaveItem) println() {
-	fmt.Println(e.Type, e.Md5, e.ShaSum)
+// WithBaseline uses m as the trusted state of the enclave. The caller is
+// responsible for verifying its signature first.
+func WithBaseline(m *Manifest) Option {
+	return func(e *Enclave) {
+		e.stable = m.enclave()
+	}
+}
+
+// WithDebounce sets how long Watch waits for a burst of events to settle.
+func WithDebounce(d time.Duration) Option {
+	return func(e *Enclave) {
+		e.debounce = d
+	}
 }
 
-// Get the state of the enclave when the program starts.
-func init() {
-	Scan()
-	// This copy only happens once.
-	for k, v := range scannedEnclave {
-		stableEnclave[k] = v
-		stableList = append(stableList,
-			scannedEnclave[k].Name+"."+scannedEnclave[k].Type)
+// WithRescan sets how often Watch performs a full rescan.
+func WithRescan(d time.Duration) Option {
+	return func(e *Enclave) {
+		e.rescan = d
+	}
+}
+
+// WithScanObserver calls fn with the time taken by every full scan.
+func WithScanObserver(fn func(time.Duration)) Option {
+	return func(e *Enclave) {
+		e.observe = fn
+	}
+}
+
+// New returns an Enclave rooted at root. Until a baseline is loaded every
+// item found by Scan is reported as added.
+func New(root string, opts ...Option) *Enclave {
+	e := &Enclave{
+		root:     root,
+		debounce: 200 * time.Millisecond,
+		rescan:   30 * time.Second,
+		stable:   enclaveMap{},
+		scanned:  enclaveMap{},
+		requests: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(e)
 	}
+	return e
 }
 
-// Scan scans the SGX enclave binaries.
-func Scan() {
-	path := config.NewConfig("config").Bin()
-	err := filepath.Walk(path, walk)
+// Root returns the directory monitored by the enclave.
+func (e *Enclave) Root() string {
+	return e.root
+}
+
+// LoadBaseline verifies the signed manifest against the operator's public
+// key and makes it the trusted state of the enclave.
+func (e *Enclave) LoadBaseline(manifestPath, publicKeyPath string) error {
+	m, err := ReadManifest(manifestPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	pub, err := LoadPublicKey(publicKeyPath)
+	if err != nil {
+		return err
+	}
+	if err := m.Verify(pub); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.stable = m.enclave()
+	e.mu.Unlock()
+	return nil
 }
 
-// walk process information about each file and directory in the SGX enclave.
-func walk(path string, _ os.FileInfo, _ error) error {
-	fileInfo, err := os.Stat(path)
+// Scan rescans every item in the enclave.
+func (e *Enclave) Scan() error {
+	start := time.Now()
+	em, _, err := scanDir(e.root)
 	if err != nil {
 		return err
 	}
-	mode := fileInfo.Mode()
-	name := fileInfo.Name()
-	switch {
-	case mode.IsRegular():
-		key := name + ".f"
-		scannedEnclave[key] =
-			enclaveItem{Name: name, Path: path, Type: "f", Md5: getMd5(path), ShaSum: getShaSum(path)}
-		scannedList = append(scannedList, key)
-	case mode.IsDir():
-		key := name + ".d"
-		scannedEnclave[key] =
-			enclaveItem{Name: name, Path: path, Type: "d", Md5: "", ShaSum: getShaSum(path)}
-		scannedList = append(scannedList, key)
-	default:
-		key := name + ".u"
-		scannedEnclave[key] =
-			enclaveItem{Name: name, Path: path, Type: "u", Md5: "", ShaSum: getShaSum(path)}
-		scannedList = append(scannedList, key)
+	e.mu.Lock()
+	e.scanned = em
+	e.mu.Unlock()
+	if e.observe != nil {
+		e.observe(time.Since(start))
 	}
 	return nil
 }
 
-// getMd5 returns the md5 encoding of a string, in hex.
-func getMd5(aString string) string {
-	data, err := os.ReadFile(aString)
+// RequestScan asks Watch, or a loop reading ScanRequests, for a full
+// rescan now. Requests made while one is pending are merged.
+func (e *Enclave) RequestScan() {
+	select {
+	case e.requests <- struct{}{}:
+	default:
+	}
+}
+
+// ScanRequests returns the channel on which RequestScan delivers.
+func (e *Enclave) ScanRequests() <-chan struct{} {
+	return e.requests
+}
+
+// scanDir walks root and returns every item found, keyed by its path
+// relative to root.
+func scanDir(root string) (enclaveMap, []string, error) {
+	em := enclaveMap{}
+	var list []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		item, err := newItem(path, rel, info)
+		if err != nil {
+			return err
+		}
+		em[rel] = item
+		list = append(list, rel)
+		return nil
+	})
 	if err != nil {
-		log.Panic(err)
+		return nil, nil, err
 	}
-	m := md5.New()
-	m.Write(data)
-	return hex.EncodeToString(m.Sum(nil))
+	sort.Strings(list)
+	return em, list, nil
 }
 
-// getShaSum returns the sha256 encoding of a string, in hex.
-func getShaSum(aString string) string {
+// newItem records a single file or directory found at path.
+func newItem(path, rel string, info os.FileInfo) (enclaveItem, error) {
+	item := enclaveItem{Name: info.Name(), Path: rel, Size: info.Size(), Mode: info.Mode()}
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		item.Type = "f"
+		sum, err := HashFile(path)
+		if err != nil {
+			return item, err
+		}
+		item.ShaSum = sum
+	case mode.IsDir():
+		item.Type = "d"
+		item.Size = 0
+	default:
+		item.Type = "u"
+	}
+	return item, nil
+}
+
+// HashFile returns the sha256 of the contents of a file, in hex.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
 	h := sha256.New()
-	h.Write([]byte(aString))
-	return hex.EncodeToString(h.Sum(nil))
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 /*************
 	Errors
 **************/
 
-// EnclaveError is used to express enclave errors.
-type enclaveError struct {
-	What string
+// EnclaveError is returned by IsValid and carries every discrepancy found.
+type EnclaveError struct {
+	Changes []Change
 }
 
-func (e enclaveError) Error() string {
-	return fmt.Sprintf("%v", e.What)
-}
-
-// IsValid determines if a scanned directory matches a valid one.
-func IsValid() (err_ error) {
-	err_ = nil
-	diff := len(stableEnclave) - len(scannedEnclave)
-	switch {
-	case diff > 0:
-		return enclaveError{"SGX SIMULATOR ENCLAVE: File removed!"}
-	case diff < 0:
-		return enclaveError{"SGX SIMULATOR ENCLAVE: Rogue file added!"}
-	default:
-		return checkFileStatus()
+func (e EnclaveError) Error() string {
+	var b strings.Builder
+	for i, c := range e.Changes {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(c.String())
 	}
+	return b.String()
 }
 
-func checkFileStatus() error {
-	for _, x := range scannedList {
-		if scannedEnclave[x].Type == "f" {
-			if scannedEnclave[x].Md5 != stableEnclave[x].Md5 {
-				msg := fmt.Sprintf("SGX SIMULATOR ENCLAVE: %s chksum failed!",
-					scannedEnclave[x].Name)
-				return enclaveError{msg}
-			}
-		}
-	}
-	for _, x := range scannedList {
-		if scannedEnclave[x].ShaSum != stableEnclave[x].ShaSum {
-			if scannedEnclave[x].Type == "f" {
-				msg := fmt.Sprintf("SGX SIMULATOR ENCLAVE: file changed from %s to %s!",
-					stableEnclave[x].Name, scannedEnclave[x].Name)
-				return enclaveError{msg}
-			} else {
-				msg := fmt.Sprintf("SGX SIMULATOR ENCLAVE: directory changed from %s to %s!",
-					stableEnclave[x].Name, scannedEnclave[x].Name)
-				return enclaveError{msg}
-			}
-		}
+// IsValid determines if the latest scan matches the baseline.
+// The returned error is an EnclaveError listing every discrepancy.
+func (e *Enclave) IsValid() error {
+	if changes := e.Diff(); len(changes) > 0 {
+		return EnclaveError{Changes: changes}
 	}
 	return nil
 }
 
-// Reset the scannedEnclave to nil before the next run.
-func Reset() {
-	scannedEnclave = enclaveMap{}
-	scannedList = nil
+// println prints an enclave item.
+func (e enclaveItem) println() {
+	fmt.Println(e.Type, e.Mode, e.Size, e.ShaSum, e.Path)
 }
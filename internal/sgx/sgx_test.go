@@ -0,0 +1,270 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package sgx
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newEnclave writes a small enclave and returns it with its baseline
+// loaded.
+func newEnclave(t *testing.T, opts ...Option) *Enclave {
+	t.Helper()
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"app":           "#!/bin/sh\necho app\n",
+		"lib/crypto.so": "crypto",
+		"lib/tls.so":    "tls",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := NewManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(root, append([]Option{WithBaseline(m)}, opts...)...)
+	if err := e.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.IsValid(); err != nil {
+		t.Fatalf("untouched enclave: %v", err)
+	}
+	return e
+}
+
+// kinds returns the path and kind of each change.
+func kinds(changes []Change) [][2]string {
+	var got [][2]string
+	for _, c := range changes {
+		got = append(got, [2]string{c.Path, string(c.Kind)})
+	}
+	return got
+}
+
+func TestDiff(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		tamper func(root string) error
+		want   [][2]string
+	}{
+		{"added file", func(root string) error {
+			return os.WriteFile(filepath.Join(root, "lib", "rogue.so"), []byte("rogue"), 0o644)
+		}, [][2]string{{"lib/rogue.so", "added"}}},
+		{"added directory", func(root string) error {
+			return os.Mkdir(filepath.Join(root, "plugins"), 0o755)
+		}, [][2]string{{"plugins", "added"}}},
+		{"removed file", func(root string) error {
+			return os.Remove(filepath.Join(root, "lib", "tls.so"))
+		}, [][2]string{{"lib/tls.so", "removed"}}},
+		{"removed directory", func(root string) error {
+			return os.RemoveAll(filepath.Join(root, "lib"))
+		}, [][2]string{{"lib", "removed"}, {"lib/crypto.so", "removed"}, {"lib/tls.so", "removed"}}},
+		{"modified contents", func(root string) error {
+			return os.WriteFile(filepath.Join(root, "app"), []byte("#!/bin/sh\necho pwned\n"), 0o755)
+		}, [][2]string{{"app", "modified"}}},
+		{"same size, other contents", func(root string) error {
+			return os.WriteFile(filepath.Join(root, "lib", "tls.so"), []byte("TLS"), 0o755)
+		}, [][2]string{{"lib/tls.so", "modified"}}},
+		{"file replaced by a directory", func(root string) error {
+			path := filepath.Join(root, "app")
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			return os.Mkdir(path, 0o755)
+		}, [][2]string{{"app", "modified"}}},
+		{"permissions", func(root string) error {
+			return os.Chmod(filepath.Join(root, "app"), 0o777)
+		}, [][2]string{{"app", "permissions"}}},
+		{"several", func(root string) error {
+			return errors.Join(
+				os.Remove(filepath.Join(root, "lib", "crypto.so")),
+				os.WriteFile(filepath.Join(root, "lib", "crypto.so.1"), []byte("crypto"), 0o755),
+				os.WriteFile(filepath.Join(root, "app"), nil, 0o755),
+			)
+		}, [][2]string{{"app", "modified"}, {"lib/crypto.so", "removed"}, {"lib/crypto.so.1", "added"}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEnclave(t)
+			if err := tt.tamper(e.Root()); err != nil {
+				t.Fatal(err)
+			}
+			// Diff reports the latest scan, not the disk.
+			if changes := e.Diff(); len(changes) != 0 {
+				t.Fatalf("Diff before Scan = %v", changes)
+			}
+			if err := e.Scan(); err != nil {
+				t.Fatal(err)
+			}
+			changes := e.Diff()
+			if got := kinds(changes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff = %v, want %v", got, tt.want)
+			}
+			var ee EnclaveError
+			if err := e.IsValid(); !errors.As(err, &ee) || !reflect.DeepEqual(ee.Changes, changes) {
+				t.Errorf("IsValid = %v, want the changes of Diff", err)
+			}
+		})
+	}
+}
+
+func TestDiffHashes(t *testing.T) {
+	e := newEnclave(t)
+	path := filepath.Join(e.Root(), "lib", "tls.so")
+	old, err := HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("tls 1.3"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	cur, err := HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{{Kind: Modified, Path: "lib/tls.so", Type: "f", OldHash: old, NewHash: cur,
+		OldSize: 3, NewSize: 7, OldMode: 0o755, NewMode: 0o755}}
+	if got := e.Diff(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff = %+v, want %+v", got, want)
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	e := newEnclave(t)
+	old, err := NewManifest(e.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(e.Root(), "app")); err != nil {
+		t.Fatal(err)
+	}
+	cur, err := NewManifest(e.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := kinds(DiffManifests(old, cur)), [][2]string{{"app", "removed"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffManifests = %v, want %v", got, want)
+	}
+}
+
+// watch runs Watch on e and returns the reports it makes, and a function
+// that stops it and returns its error.
+func watch(t *testing.T, e *Enclave) (<-chan []Change, func() error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	reports := make(chan []Change, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- e.Watch(ctx, func(c []Change) { reports <- c })
+	}()
+	var (
+		once sync.Once
+		err  error
+	)
+	stop := func() error {
+		once.Do(func() {
+			cancel()
+			err = <-done
+		})
+		return err
+	}
+	t.Cleanup(func() { _ = stop() })
+	return reports, stop
+}
+
+// await returns the first report that matches want, or fails the test
+// after a few seconds.
+func await(t *testing.T, reports <-chan []Change, want [][2]string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	var last [][2]string
+	for {
+		select {
+		case c := <-reports:
+			if last = kinds(c); reflect.DeepEqual(last, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no report of %v; the last was %v", want, last)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	e := newEnclave(t, WithDebounce(20*time.Millisecond), WithRescan(time.Hour))
+	reports, stop := watch(t, e)
+	// The initial scan is reported at once.
+	await(t, reports, nil)
+
+	rogue := filepath.Join(e.Root(), "lib", "rogue.so")
+	if err := os.WriteFile(rogue, []byte("rogue"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	await(t, reports, [][2]string{{"lib/rogue.so", "added"}})
+
+	// Items in a new directory are watched too.
+	plugin := filepath.Join(e.Root(), "plugins", "p.so")
+	if err := os.Mkdir(filepath.Dir(plugin), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	await(t, reports, [][2]string{{"lib/rogue.so", "added"}, {"plugins", "added"}})
+	if err := os.WriteFile(plugin, []byte("p"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	await(t, reports, [][2]string{{"lib/rogue.so", "added"}, {"plugins", "added"}, {"plugins/p.so", "added"}})
+
+	// Putting the enclave back clears the changes.
+	if err := errors.Join(os.Remove(rogue), os.RemoveAll(filepath.Dir(plugin))); err != nil {
+		t.Fatal(err)
+	}
+	await(t, reports, nil)
+
+	if err := os.WriteFile(filepath.Join(e.Root(), "app"), []byte("pwned"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	await(t, reports, [][2]string{{"app", "modified"}})
+
+	if err := stop(); err != nil {
+		t.Errorf("Watch = %v after the context was canceled", err)
+	}
+}
+
+func TestWatchRequestScan(t *testing.T) {
+	// Without events or the rescan, a change is found when a scan is
+	// requested.
+	e := newEnclave(t, WithDebounce(time.Hour), WithRescan(time.Hour))
+	reports, _ := watch(t, e)
+	await(t, reports, nil)
+	if err := os.Remove(filepath.Join(e.Root(), "lib", "tls.so")); err != nil {
+		t.Fatal(err)
+	}
+	e.RequestScan()
+	await(t, reports, [][2]string{{"lib/tls.so", "removed"}})
+}
+
+func TestWatchRescan(t *testing.T) {
+	e := newEnclave(t, WithDebounce(time.Hour), WithRescan(50*time.Millisecond))
+	reports, _ := watch(t, e)
+	await(t, reports, nil)
+	if err := os.Chmod(filepath.Join(e.Root(), "app"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	await(t, reports, [][2]string{{"app", "permissions"}})
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package sgx
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch monitors the enclave with fsnotify until ctx is done.
+//
+// Bursts of create/write/remove/rename/chmod events are debounced and only
+// the paths they name are re-hashed. The whole enclave is rescanned every
+// rescan interval as a safety net for missed events, and whenever
+// RequestScan is called. report is called with the result of Diff after
+// the initial scan and after every update.
+func (e *Enclave) Watch(ctx context.Context, report func([]Change)) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	full := func() error {
+		if err := e.Scan(); err != nil {
+			return err
+		}
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		for rel, x := range e.scanned {
+			if x.Type == "d" {
+				// Directories may vanish between the walk and the add.
+				_ = w.Add(filepath.Join(e.root, filepath.FromSlash(rel)))
+			}
+		}
+		return nil
+	}
+	if err := full(); err != nil {
+		return err
+	}
+	report(e.Diff())
+
+	pending := map[string]bool{}
+	settle := time.NewTimer(e.debounce)
+	settle.Stop()
+	ticker := time.NewTicker(e.rescan)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			rel, err := filepath.Rel(e.root, ev.Name)
+			if err != nil {
+				return err
+			}
+			pending[filepath.ToSlash(rel)] = true
+			settle.Reset(e.debounce)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			if !errors.Is(err, fsnotify.ErrEventOverflow) {
+				return err
+			}
+			// Events were dropped; only a full rescan can be trusted.
+			pending["."] = true
+			settle.Reset(e.debounce)
+		case <-settle.C:
+			if pending["."] {
+				if err := full(); err != nil {
+					return err
+				}
+			} else {
+				for rel := range pending {
+					if err := e.rescanPath(w, rel); err != nil {
+						return err
+					}
+				}
+			}
+			pending = map[string]bool{}
+			report(e.Diff())
+		case <-ticker.C:
+			if err := full(); err != nil {
+				return err
+			}
+			report(e.Diff())
+		case <-e.requests:
+			if err := full(); err != nil {
+				return err
+			}
+			report(e.Diff())
+		}
+	}
+}
+
+// rescanPath refreshes the scanned state of rel, and everything below it
+// if it is a directory, leaving the rest of the enclave untouched.
+func (e *Enclave) rescanPath(w *fsnotify.Watcher, rel string) error {
+	found, err := e.scanPath(rel)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k := range e.scanned {
+		if k == rel || strings.HasPrefix(k, rel+"/") {
+			delete(e.scanned, k)
+		}
+	}
+	for k, x := range found {
+		e.scanned[k] = x
+		if x.Type == "d" {
+			_ = w.Add(filepath.Join(e.root, filepath.FromSlash(k)))
+		}
+	}
+	return nil
+}
+
+// scanPath hashes rel, and everything below it if it is a directory.
+// An item that no longer exists yields an empty map.
+func (e *Enclave) scanPath(rel string) (enclaveMap, error) {
+	p := filepath.Join(e.root, filepath.FromSlash(rel))
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return enclaveMap{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		item, err := newItem(p, rel, info)
+		if os.IsNotExist(err) {
+			return enclaveMap{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return enclaveMap{rel: item}, nil
+	}
+	em, _, err := scanDir(p)
+	if os.IsNotExist(err) {
+		return enclaveMap{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	found := enclaveMap{}
+	for k, x := range em {
+		x.Path = path.Join(rel, k)
+		found[x.Path] = x
+	}
+	return found, nil
+}
@@ -0,0 +1,472 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/audit"
+	"github.com/donaldww/idemo2/internal/blockchain"
+	"github.com/donaldww/idemo2/internal/config"
+	"github.com/donaldww/idemo2/internal/events"
+	"github.com/donaldww/idemo2/internal/logger"
+	"github.com/donaldww/idemo2/internal/money"
+	"github.com/donaldww/idemo2/internal/response"
+	"github.com/donaldww/idemo2/internal/risk"
+	"github.com/donaldww/idemo2/internal/term"
+	"github.com/mum4k/termdash/cell"
+	"github.com/mum4k/termdash/widgets/text"
+)
+
+// assetName is the form of the name of an asset, such as IC or USD.
+var assetName = regexp.MustCompile(`^[A-Z][A-Z0-9]{0,9}$`)
+
+var errFunds = errors.New("insufficient funds")
+
+// holdings are the amounts of each asset held by an account.
+type holdings map[string]money.Amount
+
+// apply adds the legs to the holdings: all of them, or none when one
+// would overflow or go below zero.
+func (h holdings) apply(legs []blockchain.Leg) error {
+	next := holdings{}
+	for _, l := range legs {
+		cur, ok := next[l.Asset]
+		if !ok {
+			cur = h[l.Asset]
+		}
+		v, err := cur.Add(l.Amount)
+		if err != nil {
+			return err
+		}
+		if v < 0 {
+			return errFunds
+		}
+		next[l.Asset] = v
+	}
+	for a, v := range next {
+		h[a] = v
+	}
+	return nil
+}
+
+func (h holdings) clone() holdings {
+	c := make(holdings, len(h))
+	for a, v := range h {
+		c[a] = v
+	}
+	return c
+}
+
+// Exchange executes orders against the account and shows its holdings in
+// a text widget. Orders from node connections and from the dashboard go
+// through the same Exchange. It is safe for concurrent use.
+type Exchange struct {
+	mu       sync.Mutex
+	b        *text.Text
+	r        *response.Responder
+	al       *audit.Log
+	bus      *events.Bus
+	log      *slog.Logger
+	risk     *risk.Engine
+	account  string
+	base     string   // asset of the balance, traded by orders without a price
+	quote    string   // asset prices are in
+	open     holdings // opening holdings
+	holdings holdings
+	history  []Entry
+	others   map[string]holdings // holdings of the accounts credited by transfers
+}
+
+// NewExchange returns an Exchange for the configured account, opened with
+// the configured holdings. Orders are refused while r reports that
+// trading is halted, or when they break a rule of rk. Trades and reloads
+// are recorded in the audit log al, and every change of balance is
+// published on bus.
+func NewExchange(b *text.Text, r *response.Responder, rk *risk.Engine, al *audit.Log, bus *events.Bus,
+	cf *config.Config) *Exchange {
+	s := cf.Settings()
+	ex := &Exchange{
+		b:       b,
+		r:       r,
+		al:      al,
+		bus:     bus,
+		log:     logger.For(logger.TCP),
+		risk:    rk,
+		account: s.AccountID,
+		base:    s.BaseAsset,
+		quote:   s.QuoteAsset,
+		others:  map[string]holdings{},
+	}
+	ex.open = holdings{ex.base: s.OpenBal}
+	if ex.quote != "" {
+		ex.open[ex.quote] = s.OpenQuote
+	}
+	ex.reload()
+	return ex
+}
+
+// Execute runs one order line, such as "buy 10", "buy 10 IC 2.50",
+// "sell 5", "bal" or "reload", a query of the history of the account, or
+// "explain" followed by an order, and returns the reply for the trader.
+// A reply may take several lines.
+func (ex *Exchange) Execute(line string) string {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return refuse("invalid command.")
+	}
+	switch fields[0] {
+	case "history":
+		return ex.historyReply(fields[1:])
+	case "statement":
+		return ex.statement(fields[1:])
+	case "explain":
+		return ex.explain(fields[1:])
+	case "bal":
+		switch len(fields) {
+		case 1:
+			return fmt.Sprintf("current balance: %s.", ex.format(ex.holdings))
+		case 2:
+			return fmt.Sprintf("balance of %s: %s.", fields[1], ex.format(ex.holdingsOf(fields[1])))
+		}
+		return refuse("too many parameters.")
+	}
+	if ex.r.TradingHalted() {
+		logMsg := fmt.Sprintf("%s order: BLOCKED: enclave tampered!", fields[0])
+		ex.log.Warn(logMsg, "account", ex.account, "side", fields[0])
+		logger.Audit(ex.log, ex.al, audit.Trade, fields[0]+" order: blocked: enclave tampered",
+			map[string]string{"account": ex.account, "side": fields[0], "result": "blocked: enclave tampered"})
+		return refuse("trade blocked: enclave tampered!")
+	}
+	switch fields[0] {
+	case "buy", "sell":
+		return ex.order(fields[0], fields[1:])
+	case "transfer":
+		return ex.transfer(fields[1:])
+	case "reload":
+		if len(fields) > 1 {
+			return refuse("too many parameters.")
+		}
+		old := ex.holdings
+		ex.reload()
+		ex.recordEntry(Entry{Kind: "reload", Legs: ex.diff(old, ex.holdings)})
+		ex.log.Info("reload.", "account", ex.account, "balance", ex.format(ex.holdings))
+		logger.Audit(ex.log, ex.al, audit.Reload, "account reloaded",
+			map[string]string{"account": ex.account, "balance": ex.format(ex.holdings)})
+		return "account reloaded."
+	}
+	return refuse("invalid command.")
+}
+
+// Refused starts every reply that refuses a command, so that a node tells
+// a refusal from a result without knowing every reason.
+const Refused = "refused: "
+
+// refuse returns the reply refusing a command for the reason given.
+func refuse(reason string) string {
+	return Refused + reason
+}
+
+// parseOrder parses the arguments of a buy or sell, or returns the reason
+// to refuse them.
+func (ex *Exchange) parseOrder(side string, args []string) (risk.Order, string) {
+	switch {
+	case len(args) > 3:
+		return risk.Order{}, "too many parameters."
+	case len(args) != 1 && len(args) != 3:
+		return risk.Order{}, fmt.Sprintf("usage: %s <amount> [<asset> <price>]", side)
+	}
+	amt, err := money.Parse(args[0])
+	switch {
+	case err != nil:
+		return risk.Order{}, err.Error() + "."
+	case amt <= 0:
+		return risk.Order{}, "second parameter must be a positive number."
+	}
+	asset, price := ex.base, money.Amount(0)
+	if len(args) == 3 {
+		asset = args[1]
+		if !assetName.MatchString(asset) || asset == ex.quote || ex.quote == "" {
+			return risk.Order{}, fmt.Sprintf("invalid command: cannot %s %s.", side, asset)
+		}
+		price, err = money.Parse(args[2])
+		switch {
+		case err != nil:
+			return risk.Order{}, "price " + err.Error() + "."
+		case price <= 0:
+			return risk.Order{}, "price must be a positive number."
+		}
+	}
+	return risk.Order{Time: time.Now(), Account: ex.account, Side: side, Asset: asset, Amount: amt, Price: price,
+		Holdings: ex.holdings}, ""
+}
+
+// order buys or sells an asset. Without a price it moves only the base
+// asset; with one, the quote asset pays for it, or is paid, at that price.
+func (ex *Exchange) order(side string, args []string) string {
+	o, reason := ex.parseOrder(side, args)
+	if reason != "" {
+		return refuse(reason)
+	}
+	asset, amt, price := o.Asset, o.Amount, o.Price
+	if err := ex.risk.Check(o); err != nil {
+		return ex.blocked(side, asset, amt, price, err)
+	}
+	legs := []blockchain.Leg{{Asset: asset, Amount: amt}}
+	var cost money.Amount
+	if price > 0 {
+		// The cost is rounded against the trader: up on a buy, down on a sell.
+		mul := amt.MulUp
+		if side == "sell" {
+			mul = amt.Mul
+		}
+		var err error
+		if cost, err = mul(price); err != nil {
+			return ex.blocked(side, asset, amt, price, err)
+		}
+		legs = []blockchain.Leg{{Asset: asset, Amount: amt}, {Asset: ex.quote, Amount: -cost}}
+	}
+	if side == "sell" {
+		for i := range legs {
+			legs[i].Amount = -legs[i].Amount
+		}
+	}
+	if err := ex.holdings.apply(legs); err != nil {
+		return ex.blocked(side, asset, amt, price, err)
+	}
+	ex.risk.Executed(o)
+	ex.update()
+	ex.recordEntry(Entry{Kind: side, Legs: legs, Price: price})
+	logMsg := fmt.Sprintf("%s order: %s %s.", side, amt, asset)
+	ex.log.Info(logMsg, "account", ex.account, "side", side, "asset", asset, "amount", amt.String(),
+		"price", price.String(), "balance", ex.format(ex.holdings))
+	ex.trade(side, asset, amt, price, "executed")
+	reply := fmt.Sprintf("%s %s", amt, asset)
+	if price > 0 {
+		reply += fmt.Sprintf(" at %s for %s %s", price, cost, ex.quote)
+	}
+	if side == "sell" {
+		return "sold: " + reply + "."
+	}
+	return "bought: " + reply + "."
+}
+
+// blocked logs and records a refused order, with the risk rule that
+// refused it.
+func (ex *Exchange) blocked(side, asset string, amt, price money.Amount, err error) string {
+	logMsg := fmt.Sprintf("%s order: %s %s: BLOCKED!", side, amt, asset)
+	ex.log.Warn(logMsg, "account", ex.account, "side", side, "asset", asset, "amount", amt.String(),
+		"price", price.String(), "balance", ex.format(ex.holdings), "reason", err.Error(), "rule", ruleOf(err))
+	ex.trade(side, asset, amt, price, "blocked: "+err.Error())
+	return refuse("trade blocked: " + err.Error() + "!")
+}
+
+func (ex *Exchange) trade(side, asset string, amt, price money.Amount, result string) {
+	logger.Audit(ex.log, ex.al, audit.Trade, side+" order: "+result, map[string]string{
+		"account": ex.account, "side": side, "asset": asset, "amount": amt.String(),
+		"price": price.String(), "balance": ex.format(ex.holdings), "result": result,
+	})
+}
+
+// parseTransfer parses the arguments of a transfer into the order and its
+// memo, or returns the reason to refuse them.
+func (ex *Exchange) parseTransfer(args []string) (risk.Order, string, string) {
+	if len(args) < 2 {
+		return risk.Order{}, "", "usage: transfer <toAccount> <amount> [asset] [memo]"
+	}
+	to, asset, rest := args[0], ex.base, args[2:]
+	amt, err := money.Parse(args[1])
+	switch {
+	case err != nil:
+		return risk.Order{}, "", err.Error() + "."
+	case amt <= 0:
+		return risk.Order{}, "", "second parameter must be a positive number."
+	}
+	if len(rest) > 0 && ex.isAsset(rest[0]) {
+		asset, rest = rest[0], rest[1:]
+	}
+	if to == ex.account {
+		return risk.Order{}, "", "invalid command: cannot transfer to the same account."
+	}
+	return risk.Order{Time: time.Now(), Account: ex.account, Side: "transfer", Asset: asset, Amount: amt,
+		Holdings: ex.holdings, To: to}, strings.Join(rest, " "), ""
+}
+
+// transfer moves an asset, the base asset unless named, from the account
+// to another one, which is opened by its first transfer. Both holdings
+// change, or neither does.
+func (ex *Exchange) transfer(args []string) string {
+	o, memo, reason := ex.parseTransfer(args)
+	if reason != "" {
+		return refuse(reason)
+	}
+	to, asset, amt := o.To, o.Asset, o.Amount
+	other := ex.others[to]
+	if other == nil {
+		other = holdings{}
+	}
+	err := ex.risk.Check(o)
+	if err == nil {
+		err = ex.holdings.apply([]blockchain.Leg{{Asset: asset, Amount: -amt}})
+	}
+	if err == nil {
+		if err = other.apply([]blockchain.Leg{{Asset: asset, Amount: amt}}); err != nil {
+			_ = ex.holdings.apply([]blockchain.Leg{{Asset: asset, Amount: amt}})
+		}
+	}
+	if err != nil {
+		logMsg := fmt.Sprintf("transfer: %s %s to %s: BLOCKED!", amt, asset, to)
+		ex.log.Warn(logMsg, "account", ex.account, "to", to, "asset", asset, "amount", amt.String(),
+			"balance", ex.format(ex.holdings), "reason", err.Error(), "rule", ruleOf(err))
+		ex.transferred(to, asset, amt, memo, "blocked: "+err.Error())
+		return refuse("trade blocked: " + err.Error() + "!")
+	}
+	ex.risk.Executed(o)
+	ex.others[to] = other
+	ex.update()
+	ex.recordEntry(Entry{Kind: "transfer", Legs: []blockchain.Leg{{Asset: asset, Amount: -amt}}, To: to, Memo: memo})
+	logMsg := fmt.Sprintf("transfer: %s %s to %s.", amt, asset, to)
+	ex.log.Info(logMsg, "account", ex.account, "to", to, "asset", asset, "amount", amt.String(),
+		"balance", ex.format(ex.holdings))
+	ex.transferred(to, asset, amt, memo, "executed")
+	return fmt.Sprintf("transferred: %s %s to %s.", amt, asset, to)
+}
+
+// explain applies the risk rules to an order without executing it, and
+// reports the outcome of each rule.
+func (ex *Exchange) explain(args []string) string {
+	var (
+		o      risk.Order
+		reason string
+	)
+	switch {
+	case len(args) == 0:
+		return refuse("usage: explain <order>")
+	case args[0] == "buy" || args[0] == "sell":
+		o, reason = ex.parseOrder(args[0], args[1:])
+	case args[0] == "transfer":
+		o, _, reason = ex.parseTransfer(args[1:])
+	default:
+		return refuse("explain: only buy, sell and transfer orders are checked.")
+	}
+	if reason != "" {
+		return refuse("explain: " + reason)
+	}
+	order := fmt.Sprintf("%s %s %s", o.Side, o.Amount, o.Asset)
+	if o.Price > 0 {
+		order += " at " + o.Price.String()
+	}
+	if o.To != "" {
+		order += " to " + o.To
+	}
+	steps, err := ex.risk.Explain(o)
+	lines := []string{fmt.Sprintf("explain: %s passes every rule.", order)}
+	if err != nil {
+		lines[0] = fmt.Sprintf("explain: %s would be blocked: %s.", order, err)
+	}
+	for _, s := range steps {
+		lines = append(lines, fmt.Sprintf("%-24s %s", s.Rule, s.Result))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (ex *Exchange) transferred(to, asset string, amt money.Amount, memo, result string) {
+	logger.Audit(ex.log, ex.al, audit.Transfer, "transfer: "+result, map[string]string{
+		"account": ex.account, "to": to, "asset": asset, "amount": amt.String(), "memo": memo,
+		"balance": ex.format(ex.holdings), "result": result,
+	})
+}
+
+// ruleOf names the risk rule that refused an order, if one did.
+func ruleOf(err error) string {
+	var rej *risk.Rejection
+	if errors.As(err, &rej) {
+		return rej.Rule
+	}
+	return ""
+}
+
+// isAsset reports whether name is the base or quote asset, or one the
+// account holds.
+func (ex *Exchange) isAsset(name string) bool {
+	_, held := ex.holdings[name]
+	return held || name == ex.base || (name == ex.quote && name != "")
+}
+
+// holdingsOf returns the holdings of the account, or of an account
+// credited by transfers.
+func (ex *Exchange) holdingsOf(account string) holdings {
+	if account == ex.account {
+		return ex.holdings
+	}
+	return ex.others[account]
+}
+
+// assets lists the base and quote assets, then the others held, by name.
+func (ex *Exchange) assets(h holdings) []string {
+	assets := []string{ex.base}
+	if ex.quote != "" {
+		assets = append(assets, ex.quote)
+	}
+	var others []string
+	for a, v := range h {
+		if a != ex.base && a != ex.quote && v != 0 {
+			others = append(others, a)
+		}
+	}
+	sort.Strings(others)
+	return append(assets, others...)
+}
+
+// format lists the holdings, such as "1000.00 IC, 250.00 USD".
+func (ex *Exchange) format(h holdings) string {
+	var parts []string
+	for _, a := range ex.assets(h) {
+		parts = append(parts, fmt.Sprintf("%s %s", h[a], a))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// diff returns the legs that turn the holdings old into new.
+func (ex *Exchange) diff(old, new holdings) []blockchain.Leg {
+	all := holdings{}
+	for _, h := range []holdings{old, new} {
+		for a := range h {
+			all[a] = 1
+		}
+	}
+	var legs []blockchain.Leg
+	for _, a := range ex.assets(all) {
+		if d := new[a] - old[a]; d != 0 {
+			legs = append(legs, blockchain.Leg{Asset: a, Amount: d})
+		}
+	}
+	if len(legs) == 0 {
+		legs = []blockchain.Leg{{Asset: ex.base}}
+	}
+	return legs
+}
+
+// Reset the holdings before updating the balance window.
+func (ex *Exchange) reload() {
+	ex.holdings = ex.open.clone()
+	ex.update()
+}
+
+func (ex *Exchange) update() {
+	ex.b.Reset()
+	term.WriteColorf(ex.b, cell.ColorCyan, "\n Balance: ")
+	term.WriteColorf(ex.b, cell.ColorRed, "%s", ex.format(ex.holdings))
+	ex.bus.Publish(events.Balance, ex.holdings[ex.base].Float64())
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/donaldww/idemo2/internal/risk"
+)
+
+func TestTransfer(t *testing.T) {
+	ex := newExchange(t, risk.Limits{})
+	for _, tt := range []struct {
+		line string
+		want string
+	}{
+		{"transfer bob 100", "transferred: 100.00 IC to bob."},
+		{"transfer bob 50 USD rent for May", "transferred: 50.00 USD to bob."},
+		{"transfer carol 1.5 payment", "transferred: 1.50 IC to carol."},
+		{"bal", "current balance: 898.50 IC, 9950.00 USD."},
+		{"bal bob", "balance of bob: 100.00 IC, 50.00 USD."},
+		{"bal carol", "balance of carol: 1.50 IC, 0.00 USD."},
+		{"transfer bob 1000", Refused + "trade blocked: insufficient funds!"},
+		{"transfer acct 1", Refused + "invalid command: cannot transfer to the same account."},
+		{"transfer bob -1", Refused + "second parameter must be a positive number."},
+		{"transfer bob", Refused + "usage: transfer <toAccount> <amount> [asset] [memo]"},
+		{"bal", "current balance: 898.50 IC, 9950.00 USD."},
+	} {
+		if got := ex.Execute(tt.line); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+	last := ex.history[len(ex.history)-1]
+	if last.Kind != "transfer" || last.To != "carol" || last.Memo != "payment" || len(last.Legs) != 1 ||
+		last.Legs[0].Amount != -150 {
+		t.Errorf("last entry = %+v, want the transfer of 1.50 IC to carol", last)
+	}
+	if ex.history[1].Memo != "rent for May" {
+		t.Errorf("memo = %q, want rent for May", ex.history[1].Memo)
+	}
+}
+
+func TestTransferRollback(t *testing.T) {
+	ex := newExchange(t, risk.Limits{})
+	// Crediting bob overflows, so the debit of the account is undone.
+	ex.others["bob"] = holdings{"IC": math.MaxInt64}
+	got := ex.Execute("transfer bob 100")
+	if got != Refused+"trade blocked: amount too large!" {
+		t.Errorf("transfer = %q, want amount too large", got)
+	}
+	if got := ex.Execute("bal"); got != "current balance: 1000.00 IC, 10000.00 USD." {
+		t.Errorf("after a refused transfer %s", got)
+	}
+	if ex.others["bob"]["IC"] != math.MaxInt64 || len(ex.history) != 0 {
+		t.Errorf("bob holds %d IC and the history %d entries, want both unchanged", ex.others["bob"]["IC"],
+			len(ex.history))
+	}
+}
+
+func TestTransferRisk(t *testing.T) {
+	ex := newExchange(t, risk.Limits{Blacklist: []string{"mallory"}, MaxOrder: 50000})
+	for _, tt := range []struct {
+		line string
+		want string
+	}{
+		{"transfer mallory 1", Refused + "trade blocked: account mallory is blacklisted (blacklist)!"},
+		{"transfer bob 600", Refused + "trade blocked: order above the limit of 500.00 IC (maxOrder)!"},
+		{"transfer bob 500", "transferred: 500.00 IC to bob."},
+	} {
+		if got := ex.Execute(tt.line); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+	if got := ex.Execute("bal mallory"); !strings.HasSuffix(got, "0.00 IC, 0.00 USD.") {
+		t.Errorf("bal mallory = %q, want nothing held", got)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/blockchain"
+	"github.com/donaldww/idemo2/internal/money"
+	"github.com/nu7hatch/gouuid"
+)
+
+// Listing sizes of the history and statement commands.
+const (
+	historyLines   = 10
+	statementLines = 20
+)
+
+// timeFormats are accepted by statement --from and --to. A date alone
+// means the whole day.
+var timeFormats = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// Entry is a trade in the history of the account.
+type Entry struct {
+	Seq   int
+	ID    string // ID of the transaction in the blockchain
+	Time  time.Time
+	Kind  string           // buy, sell, reload or transfer
+	Legs  []blockchain.Leg // change of the holdings, by asset
+	Price money.Amount     // in the quote asset, of a trade with two legs
+	After holdings         // holdings after the trade
+	To    string           // account credited by a transfer
+	Memo  string
+}
+
+// recordEntry completes the entry, adds it to the history and submits it
+// for the next block. ex.mu must be held.
+func (ex *Exchange) recordEntry(e Entry) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		panic(err)
+	}
+	e.Seq, e.ID, e.Time, e.After = len(ex.history)+1, u.String(), time.Now(), ex.holdings.clone()
+	ex.history = append(ex.history, e)
+	blockchain.Submit(blockchain.Transaction{ID: e.ID, Time: e.Time.Format(time.RFC3339Nano),
+		Account: ex.account, Kind: e.Kind, Legs: e.Legs, Price: e.Price, To: e.To, Memo: e.Memo})
+}
+
+// before returns the holdings before the trade.
+func (e Entry) before() holdings {
+	h := e.After.clone()
+	for _, l := range e.Legs {
+		h[l.Asset] -= l.Amount
+	}
+	return h
+}
+
+// historyReply lists the last n trades, historyLines by default.
+func (ex *Exchange) historyReply(args []string) string {
+	n := historyLines
+	if len(args) > 1 {
+		return refuse("usage: history [n]")
+	}
+	if len(args) == 1 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+			return refuse("history: n must be a positive number.")
+		}
+	}
+	if len(ex.history) == 0 {
+		return "history: no trades."
+	}
+	if n > len(ex.history) {
+		n = len(ex.history)
+	}
+	lines := []string{fmt.Sprintf("history: last %d of %d trades.", n, len(ex.history))}
+	for _, e := range ex.history[len(ex.history)-n:] {
+		lines = append(lines, e.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// statement lists the trades between --from and --to, a page of
+// statementLines at a time.
+func (ex *Exchange) statement(args []string) string {
+	fs := flag.NewFlagSet("statement", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	from := fs.String("from", "", "")
+	to := fs.String("to", "", "")
+	page := fs.Int("page", 1, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 || *page < 1 {
+		return refuse("usage: statement [--from time] [--to time] [--page n]")
+	}
+	begin, err := parseTime(*from, false)
+	if err != nil {
+		return refuse("statement: --from: " + err.Error())
+	}
+	end, err := parseTime(*to, true)
+	if err != nil {
+		return refuse("statement: --to: " + err.Error())
+	}
+	var entries []Entry
+	for _, e := range ex.history {
+		if !e.Time.Before(begin) && !e.Time.After(end) {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		return "statement: no trades."
+	}
+	pages := (len(entries) + statementLines - 1) / statementLines
+	if *page > pages {
+		return refuse(fmt.Sprintf("statement: the last page is %d.", pages))
+	}
+	first, last := entries[0], entries[len(entries)-1]
+	lines := []string{fmt.Sprintf("statement: %d trades, page %d of %d. Opening balance %s.",
+		len(entries), *page, pages, ex.format(first.before()))}
+	start := (*page - 1) * statementLines
+	for _, e := range entries[start:min(start+statementLines, len(entries))] {
+		lines = append(lines, e.String())
+	}
+	lines = append(lines, fmt.Sprintf("Closing balance %s.", ex.format(last.After)))
+	return strings.Join(lines, "\n")
+}
+
+// String formats the entry as a line of a listing.
+func (e Entry) String() string {
+	block := "pending"
+	if h, ok := blockchain.Height(e.ID); ok {
+		block = fmt.Sprintf("block %d", h)
+	}
+	var legs, balances []string
+	for _, l := range e.Legs {
+		legs = append(legs, l.String())
+		balances = append(balances, fmt.Sprintf("%s %s", e.After[l.Asset], l.Asset))
+	}
+	if e.Price > 0 {
+		legs = append(legs, "@"+e.Price.String())
+	}
+	s := fmt.Sprintf("#%-4d %s  %-8s %-30s  balance %s  %s", e.Seq, e.Time.Format("2006-01-02 15:04:05"),
+		e.Kind, strings.Join(legs, " "), strings.Join(balances, ", "), block)
+	if e.To != "" {
+		s += "  to " + e.To
+	}
+	if e.Memo != "" {
+		s += fmt.Sprintf(" %q", e.Memo)
+	}
+	return s
+}
+
+// parseTime parses a time in one of the timeFormats, in local time. An
+// empty string is the beginning of time, or the end when end is set; a
+// date alone ends at the end of the day.
+func parseTime(s string, end bool) (time.Time, error) {
+	if s == "" {
+		if end {
+			return time.Now(), nil
+		}
+		return time.Time{}, nil
+	}
+	for _, f := range timeFormats {
+		t, err := time.ParseInLocation(f, s, time.Local)
+		if err != nil {
+			continue
+		}
+		if end && f == "2006-01-02" {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+	return time.Time{}, errors.New("want a time such as 2006-01-02 or 2006-01-02T15:04")
+}
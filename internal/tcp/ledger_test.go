@@ -0,0 +1,165 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/donaldww/idemo2/internal/events"
+	"github.com/donaldww/idemo2/internal/response"
+	"github.com/donaldww/idemo2/internal/risk"
+	"github.com/mum4k/termdash/widgets/text"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newExchange returns an Exchange for account "acct" holding 1000.00 IC
+// and 10000.00 USD, with the limits l and no policy.
+func newExchange(t *testing.T, l risk.Limits) *Exchange {
+	t.Helper()
+	b, err := text.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &Exchange{
+		b:       b,
+		r:       response.New(t.TempDir(), response.Policy{}),
+		bus:     events.NewBus(),
+		log:     quiet,
+		risk:    risk.New(l, quiet),
+		account: "acct",
+		base:    "IC",
+		quote:   "USD",
+		open:    holdings{"IC": 100000, "USD": 1000000},
+		others:  map[string]holdings{},
+	}
+	ex.reload()
+	return ex
+}
+
+// mustExecute runs a command that must succeed.
+func mustExecute(t *testing.T, ex *Exchange, line string) string {
+	t.Helper()
+	reply := ex.Execute(line)
+	if strings.HasPrefix(reply, Refused) {
+		t.Fatalf("%s: %s", line, reply)
+	}
+	return reply
+}
+
+func TestHistory(t *testing.T) {
+	ex := newExchange(t, risk.Limits{})
+	if got := ex.Execute("history"); got != "history: no trades." {
+		t.Errorf("history of no trades = %q", got)
+	}
+	for i := 1; i <= 12; i++ {
+		mustExecute(t, ex, fmt.Sprintf("buy %d", i))
+	}
+	lines := strings.Split(mustExecute(t, ex, "history"), "\n")
+	if lines[0] != "history: last 10 of 12 trades." || len(lines) != 11 {
+		t.Fatalf("history = %q", lines)
+	}
+	if !strings.HasPrefix(lines[1], "#3 ") || !strings.HasPrefix(lines[10], "#12 ") {
+		t.Errorf("history lists %q to %q, want #3 to #12", lines[1], lines[10])
+	}
+	lines = strings.Split(mustExecute(t, ex, "history 2"), "\n")
+	if lines[0] != "history: last 2 of 12 trades." || len(lines) != 3 {
+		t.Errorf("history 2 = %q", lines)
+	}
+	lines = strings.Split(mustExecute(t, ex, "history 50"), "\n")
+	if lines[0] != "history: last 12 of 12 trades." || len(lines) != 13 {
+		t.Errorf("history 50 = %q", lines[0])
+	}
+	for _, line := range []string{"history 0", "history x", "history 1 2"} {
+		if got := ex.Execute(line); !strings.HasPrefix(got, Refused) {
+			t.Errorf("%s = %q, want a refusal", line, got)
+		}
+	}
+}
+
+func TestStatementPages(t *testing.T) {
+	ex := newExchange(t, risk.Limits{})
+	for i := 0; i < 2*statementLines+5; i++ {
+		mustExecute(t, ex, "buy 1")
+	}
+	for _, tt := range []struct {
+		args  string
+		head  string
+		first string // the first trade listed
+		n     int    // trades listed
+	}{
+		{"", "statement: 45 trades, page 1 of 3. Opening balance 1000.00 IC, 10000.00 USD.", "#1 ", statementLines},
+		{"--page 2", "statement: 45 trades, page 2 of 3. Opening balance 1000.00 IC, 10000.00 USD.", "#21 ", statementLines},
+		{"--page 3", "statement: 45 trades, page 3 of 3. Opening balance 1000.00 IC, 10000.00 USD.", "#41 ", 5},
+	} {
+		lines := strings.Split(mustExecute(t, ex, "statement "+tt.args), "\n")
+		if lines[0] != tt.head || len(lines) != tt.n+2 || !strings.HasPrefix(lines[1], tt.first) {
+			t.Errorf("statement %s = %q ... (%d lines)", tt.args, lines[:2], len(lines))
+			continue
+		}
+		if last := lines[len(lines)-1]; last != "Closing balance 1045.00 IC, 10000.00 USD." {
+			t.Errorf("statement %s ends with %q", tt.args, last)
+		}
+	}
+	if got := ex.Execute("statement --page 4"); got != Refused+"statement: the last page is 3." {
+		t.Errorf("statement --page 4 = %q", got)
+	}
+	for _, args := range []string{"--page 0", "--page x", "extra", "--colour red"} {
+		if got := ex.Execute("statement " + args); !strings.HasPrefix(got, Refused+"usage: statement") {
+			t.Errorf("statement %s = %q, want the usage", args, got)
+		}
+	}
+}
+
+func TestStatementRange(t *testing.T) {
+	ex := newExchange(t, risk.Limits{})
+	day := func(d, h int) time.Time { return time.Date(2019, 10, d, h, 0, 0, 0, time.Local) }
+	for i, at := range []time.Time{day(17, 9), day(18, 9), day(18, 18), day(19, 9)} {
+		mustExecute(t, ex, "buy 10")
+		ex.history[i].Time = at
+	}
+	for _, tt := range []struct {
+		args string
+		want string // the trades listed
+	}{
+		{"", "#1 #2 #3 #4"},
+		{"--from 2019-10-18", "#2 #3 #4"},
+		{"--to 2019-10-18", "#1 #2 #3"},
+		{"--from 2019-10-18 --to 2019-10-18", "#2 #3"},
+		{"--from 2019-10-18T12:00 --to 2019-10-19T09:00:00", "#3 #4"},
+		{"--from 2019-10-20", ""},
+	} {
+		got := mustExecute(t, ex, "statement "+tt.args)
+		var seqs []string
+		for _, line := range strings.Split(got, "\n")[1:] {
+			if strings.HasPrefix(line, "#") {
+				seqs = append(seqs, strings.Fields(line)[0])
+			}
+		}
+		if tt.want == "" {
+			if got != "statement: no trades." {
+				t.Errorf("statement %s = %q, want no trades", tt.args, got)
+			}
+			continue
+		}
+		if strings.Join(seqs, " ") != tt.want {
+			t.Errorf("statement %s lists %v, want %s", tt.args, seqs, tt.want)
+		}
+	}
+	first := strings.Split(mustExecute(t, ex, "statement --from 2019-10-18"), "\n")[0]
+	if !strings.HasSuffix(first, "Opening balance 1010.00 IC, 10000.00 USD.") {
+		t.Errorf("statement --from 2019-10-18 opens with %q, want the balance after #1", first)
+	}
+	for _, args := range []string{"--from yesterday", "--to 18/10/2026"} {
+		if got := ex.Execute("statement " + args); !strings.Contains(got, "want a time such as") {
+			t.Errorf("statement %s = %q, want a time error", args, got)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peer is a node connected to the Server.
+type Peer struct {
+	Remote string
+	Since  time.Time
+	Orders int
+}
+
+// Peers tracks the nodes connected to the Server. It is safe for
+// concurrent use.
+type Peers struct {
+	mu sync.Mutex
+	m  map[string]*Peer
+}
+
+// NewPeers returns an empty peer list.
+func NewPeers() *Peers {
+	return &Peers{m: make(map[string]*Peer)}
+}
+
+func (p *Peers) add(remote string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.m[remote] = &Peer{Remote: remote, Since: time.Now()}
+}
+
+func (p *Peers) remove(remote string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.m, remote)
+}
+
+func (p *Peers) order(remote string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if peer, ok := p.m[remote]; ok {
+		peer.Orders++
+	}
+}
+
+// List returns the connected peers, longest connected first.
+func (p *Peers) List() []Peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]Peer, 0, len(p.m))
+	for _, peer := range p.m {
+		list = append(list, *peer)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Since.Before(list[j].Since) })
+	return list
+}
@@ -2,36 +2,21 @@ package tcp
 
 import (
 	"bufio"
-	"fmt"
-	"github.com/donaldww/idemo2/internal/config"
+	"github.com/donaldww/idemo2/internal/audit"
 	"github.com/donaldww/idemo2/internal/logger"
-	"github.com/donaldww/idemo2/internal/term"
 	"io"
 	"net"
-	"strconv"
 	"strings"
-
-	"github.com/mum4k/termdash/cell"
-	"github.com/mum4k/termdash/widgets/text"
+	"time"
 )
 
-var balance int
-
-// Reset the balance before updating the balance window.
-func reload(t *text.Text, bal int) {
-	balance = bal
-	update(t)
-}
-
-func update(t *text.Text) {
-	t.Reset()
-	term.WriteColorf(t, cell.ColorCyan, "\n Balance: ")
-	term.WriteColorf(t, cell.ColorRed, "%d", balance)
-}
-
-func Server(l net.Listener, t *text.Text, b *text.Text, loggerCH chan logger.MSG, cf *config.Config) {
-	openBalance := cf.GetInt("openBal")
-	reload(b, openBalance)
+// Server accepts node connections and passes their orders to ex, serving
+// each connection in its own goroutine; ex executes one order at a time.
+// Heartbeat pings are answered with a pong. A node that sends nothing,
+// not even a ping, for idle is dropped; idle 0 waits forever. Connected
+// nodes are listed in peers. Connections are recorded in the audit log al.
+func Server(l net.Listener, ex *Exchange, peers *Peers, al *audit.Log, idle time.Duration) {
+	log := logger.For(logger.TCP)
 	defer func(l net.Listener) {
 		err := l.Close()
 		if err != nil {
@@ -39,77 +24,68 @@ func Server(l net.Listener, t *text.Text, b *text.Text, loggerCH chan logger.MSG
 		}
 	}(l)
 WAITING:
-	t.Reset()
-	msg := fmt.Sprintf("Waiting for connection...")
-	loggerCH <- logger.MSG{Msg: msg, Color: cell.ColorYellow}
+	log.Info("Waiting for connection...")
 	c, err := l.Accept()
 	if err != nil {
-		t.Reset()
-		loggerCH <- logger.MSG{Msg: "Problem with node connection.", Color: cell.ColorYellow}
+		log.Warn("Problem with node connection.", "err", err)
+		logger.Audit(log, al, audit.Connection, "accept failed: "+err.Error(), nil)
 		goto WAITING
 	}
-	t.Reset()
-	loggerCH <- logger.MSG{Msg: "Node connected.", Color: cell.ColorYellow}
+	go serve(c, ex, peers, al, idle)
+	goto WAITING
+}
+
+// serve passes the orders of one node to ex until the node disconnects or
+// is idle too long.
+func serve(c net.Conn, ex *Exchange, peers *Peers, al *audit.Log, idle time.Duration) {
+	log := logger.For(logger.TCP)
+	log.Info("Node connected.", "remote", c.RemoteAddr())
+	logger.Audit(log, al, audit.Connection, "node connected",
+		map[string]string{"remote": c.RemoteAddr().String()})
+	peers.add(c.RemoteAddr().String())
+	reader := bufio.NewReader(c)
 	for {
-		netData, thisErr := bufio.NewReader(c).ReadString('\n')
-		if thisErr == io.EOF {
-			t.Reset()
-			loggerCH <- logger.MSG{Msg: "Node connection closed.", Color: cell.ColorYellow}
-			goto WAITING
+		if idle > 0 {
+			_ = c.SetReadDeadline(time.Now().Add(idle))
+		}
+		netData, thisErr := reader.ReadString('\n')
+		if thisErr != nil {
+			msg := "node connection closed"
+			if thisErr != io.EOF {
+				msg = "node connection dropped: " + thisErr.Error()
+			}
+			log.Info("Node connection closed.", "remote", c.RemoteAddr(), "err", thisErr)
+			logger.Audit(log, al, audit.Connection, msg,
+				map[string]string{"remote": c.RemoteAddr().String()})
+			peers.remove(c.RemoteAddr().String())
+			_ = c.Close()
+			return
 		}
 		// '\n' must be trimmed from netData because ReadString() doesn't strip
 		// the EOL character for you.
-		cmd := strings.Split(strings.TrimRight(netData, "\n"), " ")
-		switch len(cmd) {
-		case 2:
-			amt, thisErr2 := strconv.Atoi(cmd[1])
-			if thisErr2 != nil {
-				_, _ = c.Write([]byte("enclave-sim: second parameter must be a number.\n"))
-				break
-			}
-			switch cmd[0] {
-			case "sell":
-				if balance-amt < 0 {
-					_, _ = c.Write([]byte("enclave-sim: trade blocked: insufficient funds!\n"))
-					logMsg := fmt.Sprintf("%s order: %d IC: BLOCKED!", cmd[0], amt)
-					t.Reset()
-					loggerCH <- logger.MSG{Msg: logMsg, Color: cell.ColorRed}
-				} else {
-					balance -= amt
-					update(b)
-					logMsg := fmt.Sprintf("%s order: %d IC.", cmd[0], amt)
-					t.Reset()
-					loggerCH <- logger.MSG{Msg: logMsg, Color: cell.ColorYellow}
-					logMsg = fmt.Sprintf("enclave-sim: sold: %d coins.\n", amt)
-					_, _ = c.Write([]byte(logMsg))
-				}
-			case "buy":
-				balance += amt
-				update(b)
-				logMsg := fmt.Sprintf("%s order: %d IC.", cmd[0], amt)
-				t.Reset()
-				loggerCH <- logger.MSG{Msg: logMsg, Color: cell.ColorYellow}
-				logMsg = fmt.Sprintf("enclave-sim: bought: %d coins.\n", amt)
-				_, _ = c.Write([]byte(logMsg))
-			default:
-				_, _ = c.Write([]byte("enclave-sim: invalid command: must be 'buy' or 'sell'.\n"))
-			}
-		case 1:
-			switch cmd[0] {
-			case "bal":
-				balMsg := fmt.Sprintf("enclave-sim: current balance: %d IC.\n", balance)
-				_, _ = c.Write([]byte(balMsg))
-			case "reload":
-				reload(b, openBalance)
-				t.Reset()
-				loggerCH <- logger.MSG{Msg: "reload.",
-					Color: cell.ColorYellow}
-				_, _ = c.Write([]byte("enclave-sim: account reloaded.\n"))
-			default:
-				_, _ = c.Write([]byte("enclave-sim: invalid command.\n"))
-			}
-		default:
-			_, _ = c.Write([]byte("enclave-sim: too many parameters.\n"))
+		line := strings.TrimRight(netData, "\r\n")
+		reply := "pong"
+		if line != "ping" {
+			peers.order(c.RemoteAddr().String())
+			reply = ex.Execute(line)
+		}
+		_, _ = c.Write(frame(reply))
+	}
+}
+
+// frame prefixes each line of a reply. Every line but the last starts with
+// "enclave-sim- ", so that a node reads up to the line that starts with
+// "enclave-sim: ".
+func frame(reply string) []byte {
+	var b strings.Builder
+	lines := strings.Split(reply, "\n")
+	for i, line := range lines {
+		if i < len(lines)-1 {
+			b.WriteString("enclave-sim- ")
+		} else {
+			b.WriteString("enclave-sim: ")
 		}
+		b.WriteString(line + "\n")
 	}
+	return []byte(b.String())
 }
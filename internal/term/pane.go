@@ -0,0 +1,214 @@
+// Copyright 2019 by Donald Wilson. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package term
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mum4k/termdash/cell"
+	"github.com/mum4k/termdash/widgets/text"
+)
+
+// renderLines is how many lines above the bottom of the view are written
+// into the widget. The widget rolls its content, so only the last lines
+// that fit are shown and there is no need to know its height.
+const renderLines = 200
+
+type segment struct {
+	text  string
+	color cell.Color
+}
+
+type line []segment
+
+func (l line) String() string {
+	var b strings.Builder
+	for _, s := range l {
+		b.WriteString(s.text)
+	}
+	return b.String()
+}
+
+// Pane keeps a bounded history of the lines written to a text widget, so
+// the view can be scrolled back, searched and frozen. It is safe for
+// concurrent use.
+type Pane struct {
+	mu      sync.Mutex
+	t       *text.Text
+	lines   []line // ring buffer of complete lines
+	start   int    // index of the oldest line in lines
+	n       int    // number of lines held
+	partial line   // the line being written, not yet ended by '\n'
+	offset  int    // lines scrolled up from the bottom
+	paused  bool
+	query   string
+}
+
+// NewPane returns a Pane that keeps up to capacity lines written to t.
+// The widget should be created with text.RollContent.
+func NewPane(t *text.Text, capacity int) *Pane {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Pane{t: t, lines: make([]line, capacity)}
+}
+
+// line returns the i'th oldest line held.
+func (p *Pane) line(i int) line {
+	return p.lines[(p.start+i)%len(p.lines)]
+}
+
+// WriteColorf adds formatted text in the given color. Text is split into
+// lines on '\n'.
+func (p *Pane) WriteColorf(color cell.Color, format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	parts := strings.Split(fmt.Sprintf(format, args...), "\n")
+	for i, s := range parts {
+		if s != "" {
+			p.partial = append(p.partial, segment{s, color})
+		}
+		if i < len(parts)-1 {
+			p.push(p.partial)
+			p.partial = nil
+		}
+	}
+	p.render()
+}
+
+// push appends a complete line, dropping the oldest when full.
+func (p *Pane) push(l line) {
+	if p.n < len(p.lines) {
+		p.lines[(p.start+p.n)%len(p.lines)] = l
+		p.n++
+	} else {
+		p.lines[p.start] = l
+		p.start = (p.start + 1) % len(p.lines)
+	}
+	// Keep a scrolled-back view anchored on the same lines.
+	if p.offset > 0 && p.offset < p.n-1 {
+		p.offset++
+	}
+}
+
+// Scroll moves the view up (positive n) or down (negative n) by n lines.
+func (p *Pane) Scroll(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offset += n
+	p.clamp()
+	p.render()
+}
+
+// Bottom returns the view to the newest line.
+func (p *Pane) Bottom() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offset = 0
+	p.render()
+}
+
+func (p *Pane) clamp() {
+	if p.offset > p.n-1 {
+		p.offset = p.n - 1
+	}
+	if p.offset < 0 {
+		p.offset = 0
+	}
+}
+
+// SetPaused freezes or unfreezes the view. Lines written while the view is
+// frozen are kept and shown when it is unfrozen.
+func (p *Pane) SetPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+	p.render()
+}
+
+// Search highlights every occurrence of query and scrolls to the newest
+// line containing it. An empty query clears the highlighting. It returns
+// false if no line matches.
+func (p *Pane) Search(query string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.query = query
+	if query == "" {
+		p.render()
+		return true
+	}
+	return p.findFrom(-1, 1)
+}
+
+// Next scrolls to the next older match, or the next newer one when older
+// is false. It returns false if there is none.
+func (p *Pane) Next(older bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.query == "" {
+		return false
+	}
+	if older {
+		return p.findFrom(p.offset, 1)
+	}
+	return p.findFrom(p.offset, -1)
+}
+
+// findFrom scans from offset in direction dir (1 is older) and moves the
+// view to the first matching line.
+func (p *Pane) findFrom(offset, dir int) bool {
+	for o := offset + dir; o >= 0 && o < p.n; o += dir {
+		if strings.Contains(p.line(p.n-1-o).String(), p.query) {
+			p.offset = o
+			p.render()
+			return true
+		}
+	}
+	p.render()
+	return false
+}
+
+// render redraws the widget from the history.
+func (p *Pane) render() {
+	if p.paused {
+		return
+	}
+	p.t.Reset()
+	end := p.n - p.offset
+	begin := end - renderLines
+	if begin < 0 {
+		begin = 0
+	}
+	for i := begin; i < end; i++ {
+		p.writeLine(p.line(i))
+		_ = p.t.Write("\n")
+	}
+	if p.offset == 0 {
+		p.writeLine(p.partial)
+	}
+}
+
+func (p *Pane) writeLine(l line) {
+	for _, s := range l {
+		p.writeSegment(s)
+	}
+}
+
+// writeSegment writes s, highlighting any occurrence of the search query.
+func (p *Pane) writeSegment(s segment) {
+	rest := s.text
+	for p.query != "" {
+		i := strings.Index(rest, p.query)
+		if i < 0 {
+			break
+		}
+		WriteColorf(p.t, s.color, "%s", rest[:i])
+		_ = p.t.Write(p.query, text.WriteCellOpts(cell.FgColor(cell.ColorBlack), cell.BgColor(cell.ColorYellow)))
+		rest = rest[i+len(p.query):]
+	}
+	WriteColorf(p.t, s.color, "%s", rest)
+}